@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/hook"
+	"os"
+	"strings"
+	"time"
+)
+
+func download(args []string) int {
+	progress, interval, noHooks := "json", time.Second, false
+	j, code, ok := parseJob("download", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&progress, "progress", "json", "progress output on stdout: json or none")
+		fs.DurationVar(&interval, "interval", time.Second, "interval between json progress lines")
+		fs.BoolVar(&noHooks, "no-hooks", false, "skip the post-download hooks")
+	})
+	if !ok {
+		return code
+	}
+	if progress != "json" && progress != "none" {
+		fmt.Fprintf(os.Stderr, "unknown progress %q, expected json or none\n", progress)
+		return exitUsage
+	}
+	info, err := j.mapInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	dl := downloader.NewDownLoader(info, 4096, 4096, j.Workers)
+	// keep stdout for progress lines
+	dl.SetLog(os.Stderr)
+	if j.Schedule != "" {
+		if err := dl.SetSchedule(j.Schedule); err != nil {
+			fmt.Fprintln(os.Stderr, "schedule err", err)
+			return exitUsage
+		}
+	}
+	if len(j.Proxies) != 0 {
+		if err := dl.SetProxies(j.Proxies); err != nil {
+			fmt.Fprintln(os.Stderr, "proxy err", err)
+			return exitUsage
+		}
+	}
+	if dl.GetTaskInfo() == 0 {
+		fmt.Fprintln(os.Stderr, "no tiles in bbox")
+		return exitError
+	}
+
+	var r *reporter
+	if progress == "json" {
+		r = newReporter(os.Stdout, dl)
+		unsubscribe := dl.Subscribe(r.event)
+		defer unsubscribe()
+		stop := make(chan struct{})
+		defer close(stop)
+		go r.tick(interval, stop)
+	}
+	if !dl.Start() {
+		return exitError
+	}
+	p := dl.Progress()
+	switch {
+	case p.Done == 0 && p.Failed != 0:
+		return exitError
+	case p.Failed != 0:
+		code = exitFailed
+	default:
+		code = exitOK
+	}
+
+	hooks := config.HOOKS
+	if j.Hooks != nil {
+		hooks = j.Hooks
+	}
+	if noHooks {
+		return code
+	}
+	for _, result := range hook.Run(hooks, &hook.Summary{DbPath: info.DbPath, Info: info, Progress: p}) {
+		if r != nil {
+			r.hook(result)
+		} else {
+			fmt.Fprintln(os.Stderr, result)
+		}
+		if result.Err != nil {
+			code = exitFailed
+		}
+	}
+	return code
+}
+
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
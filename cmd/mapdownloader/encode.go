@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"os"
+)
+
+func encode(args []string) int {
+	j, code, ok := parseJob("encode", args, nil)
+	if !ok {
+		return code
+	}
+	info, err := j.mapInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	info.DbPath = ""
+	var key []byte
+	if v, ok := downloader.Secret(config.CONFIG_KEY); ok {
+		key = []byte(v)
+	}
+	str, err := downloader.EncodeMapInfo(info, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	fmt.Println(str)
+	return exitOK
+}
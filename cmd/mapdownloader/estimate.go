@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"os"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+func estimate(args []string) int {
+	asJSON, sample := false, config.SAMPLE_SIZE
+	j, code, ok := parseJob("estimate", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print json instead of a table")
+		fs.IntVar(&sample, "sample", config.SAMPLE_SIZE, "tiles to download per zoom and layer; 0 assumes a flat tile size")
+	})
+	if !ok {
+		return code
+	}
+	info, err := j.mapInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	dl := downloader.NewDownLoader(info, 1, 1, j.Workers)
+	dl.SetLog(os.Stderr)
+	dl.GetTaskInfo()
+	estimate := downloader.SizeEstimate{Layers: dl.Estimate()}
+	for _, e := range estimate.Layers {
+		estimate.Tiles += e.Tiles
+		estimate.Bytes += e.Bytes
+	}
+	estimate.Low, estimate.High = estimate.Bytes, estimate.Bytes
+	if sample > 0 {
+		var err error
+		estimate, err = dl.EstimateSize(sample)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "estimate err", err)
+			return exitError
+		}
+	}
+	if asJSON {
+		return printJSON(estimate)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "zoom\tlayer\ttiles\tsampled\tsize\t95% range\t")
+	for _, e := range estimate.Layers {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t\n", e.Zoom, config.TILE_TYPES[e.Type], e.Tiles, e.Sampled, byteSize(e.Bytes), sizeRange(e.Low, e.High))
+	}
+	fmt.Fprintf(w, "total\t\t%d\t%d\t%s\t%s\t\n", estimate.Tiles, estimate.Sampled, byteSize(estimate.Bytes), sizeRange(estimate.Low, estimate.High))
+	w.Flush()
+	if estimate.Failed != 0 {
+		fmt.Fprintf(os.Stderr, "%d sample downloads failed\n", estimate.Failed)
+	}
+	return exitOK
+}
+
+func byteSize(n int64) string {
+	return bytefmt.ByteSize(uint64(n))
+}
+
+func sizeRange(low, high int64) string {
+	if low == high {
+		return "-"
+	}
+	return byteSize(low) + " - " + byteSize(high)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"os"
+	"strings"
+)
+
+func export(args []string) int {
+	var format, out, kind string
+	db, code, ok := dbFlags("export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", downloader.ExportMBTiles, "output format: mbtiles or dir (z/x/y files)")
+		fs.StringVar(&out, "out", "", "output file or directory")
+		fs.StringVar(&kind, "type", "", "tile type to export: roadmap, satellite or overlay; defaults to the task layer")
+	})
+	if !ok {
+		return code
+	}
+	if out == "" {
+		fmt.Fprintln(os.Stderr, "out is required")
+		return exitUsage
+	}
+	tileType := -1
+	for t, name := range config.TILE_TYPES {
+		if name == kind {
+			tileType = t
+		}
+	}
+	if kind == "" {
+		dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: db}, 1, 1, 1)
+		report, err := dl.Inspect()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		if tileType = 0; report.Task != nil {
+			tileType = report.Task.Type
+		}
+	} else if tileType < 0 {
+		fmt.Fprintf(os.Stderr, "unknown type %q\n", kind)
+		return exitUsage
+	}
+
+	dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: db}, 1, 1, 1)
+	count, err := dl.Export(format, out, tileType)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export err", err)
+		return exitError
+	}
+	fmt.Printf("exported %d %s tiles to %s\n", count, config.TILE_TYPES[tileType], out)
+	return exitOK
+}
+
+func merge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	out := fs.String("out", "", "database to merge into, created if missing")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mapdownloader merge --out <db> <db>...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	if *out == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: *out}, 1, 1, 1)
+	report, err := dl.Merge(fs.Args()...)
+	fmt.Println(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "merge err", err)
+		return exitError
+	}
+	fmt.Printf("merged %s into %s\n", strings.Join(fs.Args(), ", "), *out)
+	return exitOK
+}
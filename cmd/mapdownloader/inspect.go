@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"os"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// dbFlags parses the flags of a command that works on one existing database
+// given as its only argument.
+func dbFlags(name string, args []string, extra func(fs *flag.FlagSet)) (string, int, bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mapdownloader %s [flags] <db>\n", name)
+		fs.PrintDefaults()
+	}
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return "", exitOK, false
+	} else if err != nil {
+		return "", exitUsage, false
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", exitUsage, false
+	}
+	return fs.Arg(0), exitOK, true
+}
+
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+func inspect(args []string) int {
+	asJSON := false
+	db, code, ok := dbFlags("inspect", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print json instead of a table")
+	})
+	if !ok {
+		return code
+	}
+	dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: db}, 1, 1, 1)
+	report, err := dl.Inspect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if asJSON {
+		return printJSON(report)
+	}
+
+	if t := report.Task; t != nil {
+		fmt.Printf("task:     %s layer, %s, version %s, %s\n", layerName(t.Type), t.Language, t.Version, t.Date)
+		fmt.Printf("zoom:     %d-%d\n", t.MinZ, t.MaxZ)
+		if t.MinLng != "" {
+			fmt.Printf("bbox:     %s,%s,%s,%s\n", t.MinLng, t.MaxLat, t.MaxLng, t.MinLat)
+		}
+		if t.Polygon != "" {
+			fmt.Printf("polygon:  %s\n", t.Polygon)
+		}
+	} else {
+		fmt.Println("task:     none")
+	}
+	fmt.Printf("tiles:    %d (%s)\n\n", report.Tiles, bytefmt.ByteSize(uint64(report.Bytes)))
+
+	if len(report.Tasks) > 1 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "id\tlayer\tzoom\tbbox\tdate\tdone\tfailed\tskipped")
+		for _, t := range report.Tasks {
+			bbox := "-"
+			if t.MinLng != "" {
+				bbox = t.MinLng + "," + t.MaxLat + "," + t.MaxLng + "," + t.MinLat
+			}
+			if t.Polygon != "" {
+				bbox += " (polygon)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d-%d\t%s\t%s\t%d\t%d\t%d\n", t.ID, layerName(t.Type), t.MinZ, t.MaxZ, bbox, t.Date, t.Count, t.Failed, t.Skipped)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "zoom\ttype\ttiles\texpected\tcoverage\tsize\tx\ty\t")
+	for _, z := range report.Zooms {
+		expected, coverage := "-", "-"
+		if z.Expected != 0 {
+			expected = fmt.Sprint(z.Expected)
+			coverage = fmt.Sprintf("%.1f%%", z.Coverage()*100)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%d-%d\t%d-%d\t\n", z.Zoom, config.TILE_TYPES[z.Type], z.Tiles, expected, coverage,
+			bytefmt.ByteSize(uint64(z.Bytes)), z.MinX, z.MaxX, z.MinY, z.MaxY)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func verify(args []string) int {
+	asJSON, list := false, 20
+	db, code, ok := dbFlags("verify", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print json instead of text")
+		fs.IntVar(&list, "list", 20, "list at most this many corrupt and missing tiles")
+	})
+	if !ok {
+		return code
+	}
+	dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: db}, 1, 1, 1)
+	report, err := dl.Verify()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if asJSON {
+		printJSON(report)
+	} else {
+		fmt.Println(report)
+		printTiles("corrupt", report.Corrupt, list)
+		printTiles("missing", report.Missing, list)
+	}
+	if len(report.Corrupt) != 0 || len(report.Missing) != 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func printTiles(kind string, tiles []downloader.Tile, limit int) {
+	for i, t := range tiles {
+		if i == limit {
+			fmt.Printf("  ... %d more %s tiles\n", len(tiles)-limit, kind)
+			return
+		}
+		fmt.Printf("  %s %s z=%s x=%s y=%s\n", kind, config.TILE_TYPES[t.TilesType], t.TilesLevel, t.TilesRow, t.TilesCol)
+	}
+}
+
+func layerName(layer int) string {
+	for name, l := range config.LAYERS {
+		if l == layer {
+			return name
+		}
+	}
+	return fmt.Sprint(layer)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const mercatorLat = 85.05112878
+
+// job is the shape of --config files; every field can be overridden by the
+// flag of the same name.
+type job struct {
+	Layer    string        `yaml:"layer"`
+	Lang     string        `yaml:"lang"`
+	BBox     string        `yaml:"bbox"`
+	Polygon  string        `yaml:"polygon"`
+	Zoom     string        `yaml:"zoom"`
+	Order    string        `yaml:"order"`
+	Out      string        `yaml:"out"`
+	Append   bool          `yaml:"append"`
+	Schedule string        `yaml:"schedule"`
+	Proxies  []string      `yaml:"proxies"`
+	Workers  int           `yaml:"workers"`
+	Hooks    []config.Hook `yaml:"hooks"`
+}
+
+func defaultJob() job {
+	return job{
+		Layer:   "satellite",
+		Lang:    "zh",
+		Out:     "./mapTiles.db",
+		Workers: 512,
+	}
+}
+
+func loadJob(path string) (job, error) {
+	j := defaultJob()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return j, err
+	}
+	if err := yaml.UnmarshalStrict(data, &j); err != nil {
+		return j, fmt.Errorf("%s: %v", path, err)
+	}
+	return j, nil
+}
+
+func jobFlags(name string, j *job, configPath *string, extra func(fs *flag.FlagSet)) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(configPath, "config", "", "read the job from a yaml file; flags override its fields")
+	fs.StringVar(&j.Layer, "layer", j.Layer, "layer to download: "+strings.Join(layerNames(), ", "))
+	fs.StringVar(&j.Lang, "lang", j.Lang, "label language: zh or en")
+	fs.StringVar(&j.BBox, "bbox", j.BBox, "region as minLng,minLat,maxLng,maxLat")
+	fs.StringVar(&j.Polygon, "polygon", j.Polygon, "region outline as lng,lat;lng,lat;...: only the tiles touching it are downloaded, bbox defaults to its bounds")
+	fs.StringVar(&j.Zoom, "zoom", j.Zoom, "zoom range, e.g. 12-17")
+	fs.StringVar(&j.Order, "order", j.Order, "download order: scan, zoom, spiral or hilbert")
+	fs.StringVar(&j.Out, "out", j.Out, "output database")
+	fs.BoolVar(&j.Append, "append", j.Append, "add to the output database: skip the tiles it has and record the job as another task")
+	fs.StringVar(&j.Schedule, "schedule", j.Schedule, "bandwidth schedule, e.g. 22:00-06:00=unlimited,200K")
+	fs.IntVar(&j.Workers, "workers", j.Workers, "maximum concurrent downloads")
+	fs.Var((*listFlag)(&j.Proxies), "proxy", "proxy url, may be repeated or comma separated; adds to the config file's proxies")
+	if extra != nil {
+		extra(fs)
+	}
+	return fs
+}
+
+// parseJob parses the job flags of a command, reading --config first so
+// explicit flags win over the file.
+func parseJob(name string, args []string, extra func(fs *flag.FlagSet)) (job, int, bool) {
+	j := defaultJob()
+	var configPath string
+	if err := jobFlags(name, &j, &configPath, extra).Parse(args); err == flag.ErrHelp {
+		return j, exitOK, false
+	} else if err != nil {
+		return j, exitUsage, false
+	}
+	if configPath != "" {
+		var err error
+		if j, err = loadJob(configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return j, exitUsage, false
+		}
+		jobFlags(name, &j, &configPath, extra).Parse(args)
+	}
+	return j, exitOK, true
+}
+
+func (j job) mapInfo() (downloader.MapInfo, error) {
+	info := downloader.MapInfo{
+		Language: j.Lang,
+		Order:    j.Order,
+		DbPath:   j.Out,
+		Append:   j.Append,
+	}
+	layer, ok := config.LAYERS[j.Layer]
+	if !ok {
+		return info, fmt.Errorf("unknown layer %q, expected one of %s", j.Layer, strings.Join(layerNames(), ", "))
+	}
+	info.Type = layer
+	if j.Lang != "zh" && j.Lang != "en" {
+		return info, fmt.Errorf("unknown lang %q, expected zh or en", j.Lang)
+	}
+	switch j.Order {
+	case "", downloader.OrderScan, downloader.OrderZoom, downloader.OrderSpiral, downloader.OrderHilbert:
+	default:
+		return info, fmt.Errorf("unknown order %q", j.Order)
+	}
+	if j.Out == "" {
+		return info, fmt.Errorf("out is required")
+	}
+	if j.Workers < 1 {
+		return info, fmt.Errorf("workers must be positive")
+	}
+	var err error
+	if info.MinZ, info.MaxZ, err = parseZoomRange(j.Zoom); err != nil {
+		return info, err
+	}
+	bbox := j.BBox
+	if j.Polygon != "" {
+		corners, err := downloader.ParsePolygon(j.Polygon)
+		if err != nil {
+			return info, fmt.Errorf("invalid polygon: %v", err)
+		}
+		info.Polygon = j.Polygon
+		if bbox == "" {
+			bbox = polygonBBox(corners)
+		}
+	}
+	minLng, minLat, maxLng, maxLat, err := parseBBox(bbox)
+	if err != nil {
+		return info, err
+	}
+	// MapInfo takes the north-west corner as Min and the south-east as Max.
+	info.MinLng = strconv.FormatFloat(minLng, 'f', -1, 64)
+	info.MaxLng = strconv.FormatFloat(maxLng, 'f', -1, 64)
+	info.MinLat = strconv.FormatFloat(maxLat, 'f', -1, 64)
+	info.MaxLat = strconv.FormatFloat(minLat, 'f', -1, 64)
+	return info, info.Validate()
+}
+
+func parseBBox(spec string) (minLng, minLat, maxLng, maxLat float64, err error) {
+	if spec == "" {
+		err = fmt.Errorf("bbox is required")
+		return
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		err = fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+		return
+	}
+	v := make([]float64, 4)
+	for i, part := range parts {
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+			err = fmt.Errorf("invalid bbox value %q", part)
+			return
+		}
+	}
+	minLng, maxLng = math.Min(v[0], v[2]), math.Max(v[0], v[2])
+	minLat, maxLat = math.Min(v[1], v[3]), math.Max(v[1], v[3])
+	if minLng < -180 || maxLng > 180 || minLat < -mercatorLat || maxLat > mercatorLat {
+		err = fmt.Errorf("bbox %s is outside the web mercator bounds", spec)
+	} else if minLng == maxLng || minLat == maxLat {
+		err = fmt.Errorf("bbox %s is empty", spec)
+	}
+	return
+}
+
+// polygonBBox returns the bounds of corners in the --bbox format.
+func polygonBBox(corners [][2]float64) string {
+	minLng, minLat, maxLng, maxLat := corners[0][0], corners[0][1], corners[0][0], corners[0][1]
+	for _, c := range corners[1:] {
+		minLng, maxLng = math.Min(minLng, c[0]), math.Max(maxLng, c[0])
+		minLat, maxLat = math.Min(minLat, c[1]), math.Max(maxLat, c[1])
+	}
+	bounds := []string{}
+	for _, v := range []float64{minLng, minLat, maxLng, maxLat} {
+		bounds = append(bounds, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return strings.Join(bounds, ",")
+}
+
+func parseZoomRange(spec string) (int, int, error) {
+	if spec == "" {
+		return 0, 0, fmt.Errorf("zoom is required")
+	}
+	bounds := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	from, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid zoom %q", spec)
+	}
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid zoom %q", spec)
+		}
+	}
+	if from < 0 || to > 22 || from > to {
+		return 0, 0, fmt.Errorf("zoom %q must be a range within 0-22", spec)
+	}
+	return from, to, nil
+}
+
+func layerNames() []string {
+	names := make([]string, 0, len(config.LAYERS))
+	for name := range config.LAYERS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
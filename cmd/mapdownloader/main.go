@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"mapdownloader/config"
+	"os"
+	"sort"
+)
+
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+	exitError  = 3
+)
+
+type command struct {
+	run   func(args []string) int
+	usage string
+}
+
+var commands = map[string]command{
+	"download": {download, "download tiles for a bbox and zoom range"},
+	"encode":   {encode, "print the tui config string of a job"},
+	"estimate": {estimate, "print tile counts and size per zoom and layer"},
+	"inspect":  {inspect, "print task metadata, coverage and zoom range of a database"},
+	"verify":   {verify, "decode every tile and report corrupt or missing tiles"},
+	"export":   {export, "convert a database to mbtiles or a z/x/y directory"},
+	"merge":    {merge, "copy tiles from other databases into one"},
+	"queue":    {queueCommand, "add, list and run queued download jobs"},
+	"update":   {update, "re-download changed or stale tiles of a database"},
+	"upload":   {upload, "upload a database to S3-compatible object storage"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	switch os.Args[1] {
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	case "version":
+		fmt.Println(config.VERSION)
+		return
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: mapdownloader <command> [flags]\n\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun 'mapdownloader <command> -h' for the flags of a command")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/hook"
+	"sync"
+	"time"
+)
+
+type progressLine struct {
+	Event       string  `json:"event"`
+	Time        string  `json:"time"`
+	Zoom        *int    `json:"zoom,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	Total       int64   `json:"total"`
+	Done        int64   `json:"done"`
+	Failed      int64   `json:"failed"`
+	Skipped     int64   `json:"skipped"`
+	Bytes       int64   `json:"bytes"`
+	Percent     float64 `json:"percent"`
+	TilesPerSec float64 `json:"tiles_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	Elapsed     float64 `json:"elapsed"`
+	ETA         float64 `json:"eta"`
+	// HostRates is the effective requests/s per host, Bandwidth the current
+	// byte/s cap (0 unlimited) and Workers/Active the pool concurrency.
+	HostRates map[string]float64 `json:"host_rates"`
+	Bandwidth int64              `json:"bandwidth"`
+	Workers   int                `json:"workers"`
+	Active    int                `json:"active"`
+}
+
+type hookLine struct {
+	Event   string  `json:"event"`
+	Time    string  `json:"time"`
+	Type    string  `json:"type"`
+	Output  string  `json:"output,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+// reporter writes one json object per line, either every interval or when a
+// lifecycle event happens.
+type reporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	dl  *downloader.DownLoader
+}
+
+func newReporter(w io.Writer, dl *downloader.DownLoader) *reporter {
+	return &reporter{enc: json.NewEncoder(w), dl: dl}
+}
+
+func (r *reporter) write(event string, p downloader.Progress, zoom *int, err error) {
+	line := progressLine{
+		Event:       event,
+		Time:        time.Now().Format(time.RFC3339),
+		Zoom:        zoom,
+		Total:       p.Total,
+		Done:        p.Done,
+		Failed:      p.Failed,
+		Skipped:     p.Skipped,
+		Bytes:       p.Bytes,
+		Percent:     p.Percent,
+		TilesPerSec: p.TilesPerSec,
+		BytesPerSec: p.BytesPerSec,
+		Elapsed:     p.Elapsed.Seconds(),
+		ETA:         p.ETA.Seconds(),
+		HostRates:   r.dl.GetRate(),
+		Bandwidth:   r.dl.GetBandwidth(),
+		Workers:     r.dl.GetWorkers(),
+		Active:      r.dl.GetActive(),
+	}
+	if err != nil {
+		line.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(line)
+}
+
+func (r *reporter) hook(result hook.Result) {
+	line := hookLine{
+		Event:   "hook",
+		Time:    time.Now().Format(time.RFC3339),
+		Type:    result.Hook.Type,
+		Output:  result.Output,
+		Elapsed: result.Elapsed.Seconds(),
+	}
+	if result.Err != nil {
+		line.Error = result.Err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(line)
+}
+
+func (r *reporter) event(e downloader.Event) {
+	switch e.Type {
+	case downloader.ZoomCompleted:
+		zoom := e.Zoom
+		r.write(e.Type.String(), *e.Progress, &zoom, nil)
+	case downloader.Finished:
+		r.write(e.Type.String(), *e.Progress, nil, nil)
+	case downloader.Paused, downloader.Resumed:
+		r.write(e.Type.String(), r.dl.Progress(), nil, nil)
+	}
+}
+
+func (r *reporter) tick(interval time.Duration, stop chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.write("progress", r.dl.Progress(), nil, nil)
+		case <-stop:
+			return
+		}
+	}
+}
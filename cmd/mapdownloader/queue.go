@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/queue"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var queueActions = map[string]command{
+	"add":   {queueAdd, "queue a job, with the flags of download"},
+	"list":  {queueList, "print the jobs and their state"},
+	"run":   {queueRun, "run queued jobs until the queue is empty"},
+	"retry": {queueRetry, "queue a failed or finished job again"},
+	"rm":    {queueRemove, "delete a job that is not running"},
+}
+
+func queueCommand(args []string) int {
+	if len(args) == 0 {
+		queueUsage()
+		return exitUsage
+	}
+	action, ok := queueActions[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown queue action %q\n\n", args[0])
+		queueUsage()
+		return exitUsage
+	}
+	return action.run(args[1:])
+}
+
+func queueUsage() {
+	names := make([]string, 0, len(queueActions))
+	for name := range queueActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: mapdownloader queue <action> [flags]\n\nactions:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-6s %s\n", name, queueActions[name].usage)
+	}
+}
+
+func openQueue(path string) (*queue.Queue, bool) {
+	q, err := queue.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open queue err", err)
+		return nil, false
+	}
+	return q, true
+}
+
+func queueAdd(args []string) int {
+	path, name := config.QUEUE_DB, ""
+	j, code, ok := parseJob("queue add", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&path, "queue", path, "queue database")
+		fs.StringVar(&name, "name", "", "job name (default the output file name)")
+	})
+	if !ok {
+		return code
+	}
+	info, err := j.mapInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if name == "" {
+		name = filepath.Base(info.DbPath)
+	}
+	q, ok := openQueue(path)
+	if !ok {
+		return exitError
+	}
+	defer q.Close()
+	id, err := q.Add(name, info, j.Workers, queue.Options{Schedule: j.Schedule, Proxies: j.Proxies, Hooks: j.Hooks})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	fmt.Println(id)
+	return exitOK
+}
+
+func queueList(args []string) int {
+	fs := flag.NewFlagSet("queue list", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	path := fs.String("queue", config.QUEUE_DB, "queue database")
+	asJSON := fs.Bool("json", false, "print json instead of a table")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	q, ok := openQueue(*path)
+	if !ok {
+		return exitError
+	}
+	defer q.Close()
+	jobs, err := q.Jobs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *asJSON {
+		return printJSON(jobs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "id\tname\tlayer\tzoom\tstate\tprogress\tfailed\tdb\terror")
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d-%d\t%s\t%.1f%%\t%d\t%s\t%s\n", j.ID, j.Name, layerName(j.Info.Type),
+			j.Info.MinZ, j.Info.MaxZ, j.State, j.Percent()*100, j.Failed, j.Info.DbPath, j.Err)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func queueRun(args []string) int {
+	fs := flag.NewFlagSet("queue run", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	path := fs.String("queue", config.QUEUE_DB, "queue database")
+	budget := fs.Int("budget", config.QUEUE_BUDGET, "concurrent downloads shared by all running jobs")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	q, ok := openQueue(*path)
+	if !ok {
+		return exitError
+	}
+	defer q.Close()
+	q.Budget = *budget
+	// keep stdout for job lines
+	q.Log = os.Stderr
+
+	done := make(chan error)
+	go func() {
+		done <- q.Run(nil)
+	}()
+	states := make(map[int64]queue.State)
+	report := func() int {
+		jobs, err := q.Jobs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		code := exitOK
+		for _, j := range jobs {
+			if states[j.ID] != j.State {
+				states[j.ID] = j.State
+				line := strconv.FormatInt(j.ID, 10) + " " + j.Name + " " + string(j.State)
+				if j.Err != "" {
+					line += ": " + j.Err
+				}
+				fmt.Println(line)
+			}
+			if j.State == queue.Failed {
+				code = exitFailed
+			}
+		}
+		return code
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitError
+			}
+			return report()
+		case <-ticker.C:
+			report()
+		}
+	}
+}
+
+func queueRetry(args []string) int {
+	return queueUpdate("retry", args, (*queue.Queue).Retry)
+}
+
+func queueRemove(args []string) int {
+	return queueUpdate("rm", args, (*queue.Queue).Remove)
+}
+
+func queueUpdate(name string, args []string, update func(q *queue.Queue, id int64) error) int {
+	fs := flag.NewFlagSet("queue "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	path := fs.String("queue", config.QUEUE_DB, "queue database")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if fs.NArg() != 1 || err != nil {
+		fmt.Fprintf(os.Stderr, "usage: mapdownloader queue %s [flags] <id>\n", name)
+		return exitUsage
+	}
+	q, ok := openQueue(*path)
+	if !ok {
+		return exitError
+	}
+	defer q.Close()
+	if err := update(q, id); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
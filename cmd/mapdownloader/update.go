@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mapdownloader/internal/downloader"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func update(args []string) int {
+	var older int
+	var zoom, bbox string
+	var force bool
+	db, code, ok := dbFlags("update", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&older, "older", 0, "only re-download tiles fetched more than N days ago")
+		fs.StringVar(&zoom, "zoom", "", "only re-download these zooms, e.g. 12,14-16")
+		fs.StringVar(&bbox, "bbox", "", "only re-download tiles inside minLng,minLat,maxLng,maxLat")
+		fs.BoolVar(&force, "force", false, "re-download without If-None-Match/If-Modified-Since")
+	})
+	if !ok {
+		return code
+	}
+
+	info := downloader.MapInfo{DbPath: db}
+	filter := downloader.Filter{
+		OlderThan:   time.Duration(older) * 24 * time.Hour,
+		Conditional: !force,
+	}
+	var err error
+	if filter.Zooms, err = parseZooms(zoom); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			fmt.Fprintln(os.Stderr, "bbox must be minLng,minLat,maxLng,maxLat")
+			return exitUsage
+		}
+		info.MinLng, info.MinLat, info.MaxLng, info.MaxLat = parts[0], parts[1], parts[2], parts[3]
+		info.MinZ, info.MaxZ = 0, 22
+		filter.Region = true
+	}
+
+	dl := downloader.NewDownLoader(info, 4096, 4096, 512)
+	report, err := dl.Refresh(filter)
+	fmt.Println(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "update err", err)
+		return exitError
+	}
+	if report.Failed != 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func parseZooms(spec string) ([]int, error) {
+	zooms := make([]int, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid zoom %q", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid zoom %q", part)
+			}
+		}
+		for z := from; z <= to; z++ {
+			zooms = append(zooms, z)
+		}
+	}
+	return zooms, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/hook"
+	"os"
+	"time"
+)
+
+func upload(args []string) int {
+	h := config.Hook{Type: "s3"}
+	abort, asJSON := false, false
+	db, code, ok := dbFlags("upload", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&h.Endpoint, "endpoint", "", "object store endpoint, e.g. https://oss-cn-shenzhen.aliyuncs.com")
+		fs.StringVar(&h.Region, "region", "", "signing region (default us-east-1)")
+		fs.StringVar(&h.Bucket, "bucket", "", "bucket name")
+		fs.StringVar(&h.Key, "key", config.S3_KEY, "object key template: {file}, {name}, {date}, {layer}, {minZ}, {maxZ}")
+		fs.StringVar(&h.AccessKey, "access-key", "", "access key, may reference a secret as ${NAME} (default ${AWS_ACCESS_KEY_ID})")
+		fs.StringVar(&h.SecretKey, "secret-key", "", "secret key, may reference a secret as ${NAME} (default ${AWS_SECRET_ACCESS_KEY})")
+		fs.BoolVar(&h.PathStyle, "path-style", false, "put the bucket in the path, as MinIO expects")
+		fs.BoolVar(&abort, "abort", false, "discard the parts of an unfinished upload instead of resuming it")
+		fs.BoolVar(&asJSON, "json", false, "print json instead of text")
+	})
+	if !ok {
+		return code
+	}
+
+	summary := &hook.Summary{DbPath: db, Info: downloader.MapInfo{DbPath: db}}
+	dl := downloader.NewDownLoader(downloader.MapInfo{DbPath: db}, 1, 1, 1)
+	task, err := dl.Task()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if task != nil {
+		summary.Info = task.MapInfo
+	}
+
+	if abort {
+		client, _, err := hook.S3Client(h, summary)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		if err := client.Abort(context.Background(), db); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		return exitOK
+	}
+
+	result := hook.Run([]config.Hook{h}, summary)[0]
+	if asJSON {
+		line := hookLine{Event: "hook", Time: time.Now().Format(time.RFC3339), Type: h.Type, Output: result.Output, Elapsed: result.Elapsed.Seconds()}
+		if result.Err != nil {
+			line.Error = result.Err.Error()
+		}
+		printJSON(line)
+	} else if result.Err != nil {
+		fmt.Fprintln(os.Stderr, result.Err)
+	} else {
+		fmt.Println(result.Output)
+	}
+	if result.Err != nil {
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/limiter"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/charmbracelet/bubbles/progress"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	sparkWidth = 40
+	errorLines = 6
+)
+
+var (
+	sparks     = []rune("▁▂▃▄▅▆▇█")
+	sparkStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
+	dimStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("#626262"))
+)
+
+// dashboard is the state 4 view. It only changes in Update, from tick and
+// event messages.
+type dashboard struct {
+	progress   downloader.Progress
+	sampledAt  time.Time
+	tilesRate  []float64
+	bytesRate  []float64
+	rate       map[string]float64
+	bandwidth  int64
+	proxyAlive int
+	proxyTotal int
+	workers    int
+	active     int
+	lowSpace   bool
+	errors     map[string]int
+	log        []string
+	zoomBar    *progress.Model
+}
+
+func newDashboard() *dashboard {
+	bar, _ := progress.NewModel(progress.WithScaledGradient("#FF7CCB", "#FDFF8C"), progress.WithWidth(30))
+	return &dashboard{errors: make(map[string]int), zoomBar: bar}
+}
+
+// sample reads the counters of dl and appends the throughput since the
+// previous sample to the sparklines.
+func (d *dashboard) sample(dl *downloader.DownLoader, now time.Time) {
+	p := dl.Progress()
+	if !d.sampledAt.IsZero() {
+		if secs := now.Sub(d.sampledAt).Seconds(); secs > 0 {
+			tiles := (p.Done + p.Failed + p.Skipped) - (d.progress.Done + d.progress.Failed + d.progress.Skipped)
+			d.tilesRate = appendSample(d.tilesRate, float64(tiles)/secs)
+			d.bytesRate = appendSample(d.bytesRate, float64(p.Bytes-d.progress.Bytes)/secs)
+		}
+	}
+	d.progress, d.sampledAt = p, now
+	d.rate = dl.GetRate()
+	d.bandwidth = dl.GetBandwidth()
+	d.proxyAlive, d.proxyTotal = dl.GetProxies()
+	d.workers = dl.GetWorkers()
+	d.active = dl.GetActive()
+}
+
+func appendSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	if len(samples) > sparkWidth {
+		samples = samples[len(samples)-sparkWidth:]
+	}
+	return samples
+}
+
+func (d *dashboard) event(e downloader.Event) {
+	switch e.Type {
+	case downloader.TileFailed:
+		group := errorGroup(e.Err)
+		d.errors[group]++
+		line := e.Time.Format("15:04:05") + "  " + group
+		if e.Tile != nil {
+			line += fmt.Sprintf("  %s/%s/%s", e.Tile.TilesLevel, e.Tile.TilesRow, e.Tile.TilesCol)
+		}
+		if _, ok := e.Err.(*downloader.StatusError); !ok && e.Err != nil {
+			line += "  " + e.Err.Error()
+		}
+		d.log = append(d.log, line)
+		if len(d.log) > errorLines {
+			d.log = d.log[len(d.log)-errorLines:]
+		}
+	case downloader.Paused:
+		if e.Err == downloader.ErrLowSpace {
+			d.lowSpace = true
+		}
+	case downloader.Resumed:
+		d.lowSpace = false
+	}
+}
+
+func errorGroup(err error) string {
+	if se, ok := err.(*downloader.StatusError); ok {
+		return fmt.Sprintf("HTTP %d", se.Code)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	if err == nil {
+		return "unknown"
+	}
+	return "network"
+}
+
+func (d *dashboard) View(bar *progress.Model) string {
+	p := d.progress
+	str := fmt.Sprintf("total: %d   done: %d  failed: %d  skipped: %d", p.Total, p.Done, p.Failed, p.Skipped) + "\n\n" +
+		bar.View(p.Percent) + "\n" +
+		fmt.Sprintf("elapsed: %s   eta: %s", p.Elapsed.Round(time.Second), d.eta()) + "\n\n"
+
+	str += fmt.Sprintf("tiles/s %s %.1f", sparkline(d.tilesRate), last(d.tilesRate)) + "\n" +
+		fmt.Sprintf("   MB/s %s %.2f", sparkline(d.bytesRate), last(d.bytesRate)/1024/1024) + "\n\n"
+
+	for _, z := range p.Zooms {
+		percent := 0.0
+		if z.Total != 0 {
+			percent = float64(z.Done+z.Failed) / float64(z.Total)
+		}
+		str += fmt.Sprintf("z%-3d", z.Zoom) + d.zoomBar.View(percent) +
+			dimStyle.Render(fmt.Sprintf("  %d/%d", z.Done+z.Failed, z.Total)) + "\n"
+	}
+	if len(p.Zooms) != 0 {
+		str += "\n"
+	}
+	return str + d.errorView() + d.rateView()
+}
+
+func (d *dashboard) eta() string {
+	p := d.progress
+	if p.Total != 0 && p.Done+p.Failed+p.Skipped >= p.Total {
+		return "0s"
+	}
+	if p.ETA == 0 {
+		return "-"
+	}
+	return p.ETA.Round(time.Second).String()
+}
+
+func sparkline(samples []float64) string {
+	max := 0.0
+	for _, v := range samples {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range samples {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparks)-1))
+		}
+		b.WriteRune(sparks[i])
+	}
+	return sparkStyle.Render(b.String() + strings.Repeat(" ", sparkWidth-len(samples)))
+}
+
+func last(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	return samples[len(samples)-1]
+}
+
+func (d *dashboard) errorView() string {
+	if len(d.errors) == 0 {
+		return ""
+	}
+	groups := make([]string, 0, len(d.errors))
+	for group := range d.errors {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if d.errors[groups[i]] != d.errors[groups[j]] {
+			return d.errors[groups[i]] > d.errors[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+	str := "errors:"
+	for _, group := range groups {
+		str += fmt.Sprintf("  %s ×%d", group, d.errors[group])
+	}
+	str += "\n"
+	for _, line := range d.log {
+		str += dimStyle.Render("  "+line) + "\n"
+	}
+	return str + "\n"
+}
+
+func (d *dashboard) rateView() (str string) {
+	hosts := make([]string, 0, len(d.rate))
+	for host := range d.rate {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		str += fmt.Sprintf("%s: %.1f req/s   ", host, d.rate[host])
+	}
+	if d.lowSpace {
+		str += "paused: low disk space   "
+	}
+	switch {
+	case d.bandwidth == limiter.Paused:
+		str += "bandwidth: paused by schedule   "
+	case d.bandwidth > 0:
+		str += "bandwidth: " + bytefmt.ByteSize(uint64(d.bandwidth)) + "/s   "
+	}
+	if d.workers != 0 {
+		str += fmt.Sprintf("concurrency: %d/%d   ", d.active, d.workers)
+	}
+	if d.proxyTotal != 0 {
+		str += fmt.Sprintf("proxies: %d/%d", d.proxyAlive, d.proxyTotal)
+	}
+	if str != "" {
+		str = strings.TrimSpace(str) + "\n\n"
+	}
+	return
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	fieldConfig = iota
+	fieldLayer
+	fieldLang
+	fieldOrder
+	fieldMinZ
+	fieldMaxZ
+	fieldWest
+	fieldSouth
+	fieldEast
+	fieldNorth
+	fieldOut
+	fieldMode
+)
+
+var (
+	labelStyle    = lipgloss.NewStyle().Width(14)
+	focusStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
+	optionStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("#626262"))
+	fieldErrStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF5F87"))
+)
+
+// field is a text input, or a select list when options is set.
+type field struct {
+	label   string
+	options []string
+	choice  int
+	input   textinput.Model
+	accept  func(r rune) bool
+	err     string
+}
+
+type form struct {
+	fields []*field
+	focus  int
+	// center and outline of a loaded config, which the form has no fields
+	// for
+	centerLng string
+	centerLat string
+	polygon   string
+}
+
+func newForm() *form {
+	f := &form{}
+	f.fields = []*field{
+		fieldConfig: textField("Config", "paste a config string from the portal (optional)", 0, nil),
+		fieldLayer:  selectField("Layer", layerNames()...),
+		fieldLang:   selectField("Language", "zh", "en"),
+		fieldOrder:  selectField("Order", downloader.OrderScan, downloader.OrderZoom, downloader.OrderSpiral, downloader.OrderHilbert),
+		fieldMinZ:   textField("Min zoom", "12", 2, digit),
+		fieldMaxZ:   textField("Max zoom", "17", 2, digit),
+		fieldWest:   textField("West lng", "116.312885", 12, decimal),
+		fieldSouth:  textField("South lat", "39.856128", 12, decimal),
+		fieldEast:   textField("East lng", "116.500168", 12, decimal),
+		fieldNorth:  textField("North lat", "39.973805", 12, decimal),
+		fieldOut:    textField("Output", "./mapTiles.db", 0, nil),
+		fieldMode:   selectField("Existing db", "replace", "append"),
+	}
+	f.fields[fieldConfig].input.Width = 60
+	f.set(fieldOut, "./mapTiles.db")
+	f.setFocus(fieldLayer)
+	return f
+}
+
+func textField(label, placeholder string, limit int, accept func(r rune) bool) *field {
+	ti := textinput.NewModel()
+	ti.Placeholder = placeholder
+	ti.CharLimit = limit
+	ti.Prompt = ""
+	return &field{label: label, input: ti, accept: accept}
+}
+
+func selectField(label string, options ...string) *field {
+	return &field{label: label, options: options}
+}
+
+func digit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func decimal(r rune) bool {
+	return digit(r) || r == '.' || r == '-'
+}
+
+func layerNames() []string {
+	names := make([]string, 0, len(config.LAYERS))
+	for name := range config.LAYERS {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return config.LAYERS[names[i]] < config.LAYERS[names[j]]
+	})
+	return names
+}
+
+func (f *form) setFocus(i int) tea.Cmd {
+	f.fields[f.focus].input.Blur()
+	f.focus = (i + len(f.fields)) % len(f.fields)
+	if f.fields[f.focus].options != nil {
+		return nil
+	}
+	return f.fields[f.focus].input.Focus()
+}
+
+// Update moves between fields with tab/up/down, cycles select fields with
+// left/right and drops keys a numeric field does not accept.
+func (f *form) Update(msg tea.Msg) tea.Cmd {
+	cur := f.fields[f.focus]
+	if key, ok := msg.(tea.KeyMsg); ok {
+		switch key.Type {
+		case tea.KeyTab, tea.KeyDown:
+			return f.setFocus(f.focus + 1)
+		case tea.KeyShiftTab, tea.KeyUp:
+			return f.setFocus(f.focus - 1)
+		case tea.KeyLeft, tea.KeyRight:
+			if cur.options != nil {
+				step := 1
+				if key.Type == tea.KeyLeft {
+					step = len(cur.options) - 1
+				}
+				cur.choice = (cur.choice + step) % len(cur.options)
+				return nil
+			}
+		case tea.KeyRunes:
+			if cur.options != nil {
+				return nil
+			}
+			if cur.accept != nil {
+				for _, r := range key.Runes {
+					if !cur.accept(r) {
+						return nil
+					}
+				}
+			}
+		}
+	}
+	if cur.options != nil {
+		return nil
+	}
+	var cmd tea.Cmd
+	cur.input, cmd = cur.input.Update(msg)
+	cur.err = ""
+	return cmd
+}
+
+// set changes a text field without showing a cursor in it unless focused.
+func (f *form) set(i int, value string) {
+	f.fields[i].input.SetValue(value)
+	f.fields[i].err = ""
+	if i != f.focus {
+		f.fields[i].input.Blur()
+	}
+}
+
+func (f *form) value(i int) string {
+	if f.fields[i].options != nil {
+		return f.fields[i].options[f.fields[i].choice]
+	}
+	return strings.TrimSpace(f.fields[i].input.Value())
+}
+
+func (f *form) selectOption(i int, option string) {
+	for n, o := range f.fields[i].options {
+		if o == option {
+			f.fields[i].choice = n
+		}
+	}
+}
+
+// load fills the form from a decoded config string.
+func (f *form) load(info downloader.MapInfo) {
+	for name, layer := range config.LAYERS {
+		if layer == info.Type {
+			f.selectOption(fieldLayer, name)
+		}
+	}
+	if info.Language != "" {
+		f.selectOption(fieldLang, info.Language)
+	}
+	if info.Order != "" {
+		f.selectOption(fieldOrder, info.Order)
+	}
+	f.set(fieldMinZ, strconv.Itoa(info.MinZ))
+	f.set(fieldMaxZ, strconv.Itoa(info.MaxZ))
+	f.set(fieldWest, info.MinLng)
+	f.set(fieldEast, info.MaxLng)
+	f.set(fieldNorth, info.MinLat)
+	f.set(fieldSouth, info.MaxLat)
+	f.centerLng, f.centerLat, f.polygon = info.CenterLng, info.CenterLat, info.Polygon
+	f.set(fieldConfig, "")
+}
+
+// mapInfo validates the form, marking the offending field on error.
+func (f *form) mapInfo() (downloader.MapInfo, error) {
+	for _, fl := range f.fields {
+		fl.err = ""
+	}
+	info := downloader.MapInfo{
+		Type:      config.LAYERS[f.value(fieldLayer)],
+		Language:  f.value(fieldLang),
+		Order:     f.value(fieldOrder),
+		MinLng:    f.value(fieldWest),
+		MaxLng:    f.value(fieldEast),
+		MinLat:    f.value(fieldNorth),
+		MaxLat:    f.value(fieldSouth),
+		CenterLng: f.centerLng,
+		CenterLat: f.centerLat,
+		Polygon:   f.polygon,
+		DbPath:    f.value(fieldOut),
+		Append:    f.value(fieldMode) == "append",
+	}
+	var err error
+	if info.MinZ, err = strconv.Atoi(f.value(fieldMinZ)); err != nil {
+		f.fields[fieldMinZ].err = "enter a zoom level"
+		return info, err
+	}
+	if info.MaxZ, err = strconv.Atoi(f.value(fieldMaxZ)); err != nil {
+		f.fields[fieldMaxZ].err = "enter a zoom level"
+		return info, err
+	}
+	if err := info.Validate(); err != nil {
+		if fe, ok := err.(*downloader.FieldError); ok {
+			i := map[string]int{
+				"minZ": fieldMinZ, "maxZ": fieldMaxZ,
+				"minLng": fieldWest, "maxLng": fieldEast, "minLat": fieldNorth, "maxLat": fieldSouth,
+			}[fe.Field]
+			if i != fieldConfig {
+				f.fields[i].err = fe.Msg
+			}
+		}
+		return info, err
+	}
+	if info.DbPath == "" {
+		f.fields[fieldOut].err = "enter an output path"
+		return info, &downloader.FieldError{Field: "output", Msg: "is required"}
+	}
+	return info, nil
+}
+
+func (f *form) View() string {
+	var b strings.Builder
+	for i, fl := range f.fields {
+		label := labelStyle.Render(fl.label)
+		if i == f.focus {
+			label = focusStyle.Render("> ") + label
+		} else {
+			label = "  " + label
+		}
+		b.WriteString(label)
+		if fl.options != nil {
+			for n, o := range fl.options {
+				if n == fl.choice {
+					b.WriteString(focusStyle.Render("[" + o + "]"))
+				} else {
+					b.WriteString(optionStyle.Render(" " + o + " "))
+				}
+				b.WriteString(" ")
+			}
+		} else {
+			b.WriteString(fl.input.View())
+		}
+		if fl.err != "" {
+			b.WriteString("  " + fieldErrStyle.Render(fl.err))
+		}
+		b.WriteString("\n")
+		if i == fieldConfig {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
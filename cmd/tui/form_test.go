@@ -0,0 +1,42 @@
+package main
+
+import (
+	"mapdownloader/internal/downloader"
+	"testing"
+)
+
+func TestFormLoadRoundTrip(t *testing.T) {
+	want := downloader.MapInfo{
+		Type:      1,
+		MinZ:      10,
+		MaxZ:      12,
+		DbPath:    "./tiles.db",
+		MinLng:    "116.3",
+		MaxLng:    "116.5",
+		MinLat:    "39.97",
+		MaxLat:    "39.9",
+		Language:  "en",
+		Order:     downloader.OrderSpiral,
+		CenterLng: "116.41",
+		CenterLat: "39.91",
+		Polygon:   "116.3,39.9;116.5,39.9;116.4,39.97",
+	}
+	str, err := downloader.EncodeMapInfo(want, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := downloader.DecodeMapInfo(str, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newForm()
+	f.load(info)
+	f.set(fieldOut, want.DbPath)
+	got, err := f.mapInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("form gave %+v, want %+v", got, want)
+	}
+}
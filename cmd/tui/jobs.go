@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/queue"
+	"path/filepath"
+
+	"github.com/charmbracelet/bubbles/progress"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var stateStyles = map[queue.State]lipgloss.Style{
+	queue.Queued:  lipgloss.NewStyle().Foreground(lipgloss.Color("#626262")),
+	queue.Running: lipgloss.NewStyle().Foreground(lipgloss.Color("205")),
+	queue.Done:    lipgloss.NewStyle().Foreground(lipgloss.Color("#04B575")),
+	queue.Failed:  lipgloss.NewStyle().Foreground(lipgloss.Color("#FF5F87")),
+}
+
+type queueIdleMsg struct {
+	err error
+}
+
+// jobList is the state 6 view of the job queue. The queue runs in a command
+// and the list reloads from the jobs table on every tick.
+type jobList struct {
+	queue   *queue.Queue
+	jobs    []queue.Job
+	cursor  int
+	running bool
+	err     string
+	bar     *progress.Model
+}
+
+func (l *jobList) open() error {
+	if l.queue != nil {
+		return nil
+	}
+	q, err := queue.Open(config.QUEUE_DB)
+	if err != nil {
+		return err
+	}
+	// keep the job downloads from writing over the screen
+	q.Log = ioutil.Discard
+	l.queue = q
+	l.bar, _ = progress.NewModel(progress.WithScaledGradient("#FF7CCB", "#FDFF8C"), progress.WithWidth(20))
+	l.refresh()
+	return nil
+}
+
+func (l *jobList) add(info downloader.MapInfo) error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	if _, err := l.queue.Add(filepath.Base(info.DbPath), info, 0, queue.Options{}); err != nil {
+		return err
+	}
+	l.refresh()
+	l.cursor = len(l.jobs) - 1
+	return nil
+}
+
+func (l *jobList) refresh() {
+	jobs, err := l.queue.Jobs()
+	if err != nil {
+		l.err = err.Error()
+		return
+	}
+	l.jobs = jobs
+	if l.cursor >= len(l.jobs) {
+		l.cursor = len(l.jobs) - 1
+	}
+	if l.cursor < 0 {
+		l.cursor = 0
+	}
+}
+
+// run starts the queue unless it is running or has nothing to do.
+func (l *jobList) run() tea.Cmd {
+	if l.running {
+		return nil
+	}
+	pending := false
+	for _, j := range l.jobs {
+		pending = pending || j.State == queue.Queued
+	}
+	if !pending {
+		return nil
+	}
+	l.running = true
+	q := l.queue
+	return func() tea.Msg {
+		return queueIdleMsg{q.Run(nil)}
+	}
+}
+
+func (l *jobList) idle(msg queueIdleMsg) tea.Cmd {
+	l.running = false
+	if msg.err != nil {
+		l.err = msg.err.Error()
+		return nil
+	}
+	l.refresh()
+	// a job added while Run was returning
+	return l.run()
+}
+
+// Update handles the list keys: move, retry and delete.
+func (l *jobList) Update(key tea.KeyMsg) tea.Cmd {
+	l.err = ""
+	switch key.Type {
+	case tea.KeyUp:
+		if l.cursor > 0 {
+			l.cursor--
+		}
+	case tea.KeyDown:
+		if l.cursor < len(l.jobs)-1 {
+			l.cursor++
+		}
+	case tea.KeyRunes:
+		if len(l.jobs) == 0 {
+			return nil
+		}
+		id := l.jobs[l.cursor].ID
+		var err error
+		switch string(key.Runes) {
+		case "r":
+			err = l.queue.Retry(id)
+		case "d":
+			err = l.queue.Remove(id)
+		default:
+			return nil
+		}
+		if err != nil {
+			l.err = err.Error()
+		}
+		l.refresh()
+		return l.run()
+	}
+	return nil
+}
+
+func (l *jobList) View() string {
+	if len(l.jobs) == 0 {
+		return "No jobs queued\n\n"
+	}
+	str := fmt.Sprintf("  %-4s %-20s %-10s %-6s %-8s %-26s %s\n", "id", "name", "layer", "zoom", "state", "progress", "error")
+	for i, j := range l.jobs {
+		prefix := "  "
+		if i == l.cursor {
+			prefix = focusStyle.Render("> ")
+		}
+		layer := ""
+		for name, t := range config.LAYERS {
+			if t == j.Info.Type {
+				layer = name
+			}
+		}
+		state := stateStyles[j.State].Render(fmt.Sprintf("%-8s", j.State))
+		str += prefix + fmt.Sprintf("%-4d %-20s %-10s %-6s ", j.ID, truncate(j.Name, 20), layer, fmt.Sprintf("%d-%d", j.Info.MinZ, j.Info.MaxZ)) +
+			state + " " + l.bar.View(j.Percent()) + " " + fieldErrStyle.Render(j.Err) + "\n"
+	}
+	str += "\n"
+	if l.err != "" {
+		str += fieldErrStyle.Render(l.err) + "\n\n"
+	}
+	return str
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
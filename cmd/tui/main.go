@@ -1,13 +1,12 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"mapdownloader/config"
 	"mapdownloader/internal/downloader"
-	"reflect"
+	"mapdownloader/internal/hook"
 	"strconv"
 	"time"
 
@@ -29,100 +28,284 @@ func main() {
 type model struct {
 	err           string
 	state         int
-	tilesErr      int
-	tilesDone     int
 	tilesCount    int
-	percent       float64
+	estimate      *downloader.SizeEstimate
+	estimated     bool
+	queued        bool
+	spaceErr      string
+	events        chan downloader.Event
+	eventsDone    chan struct{}
+	unsubscribe   func()
 	spinner       spinner.Model
 	progress      *progress.Model
-	textInput     textinput.Model
+	form          *form
+	dashboard     *dashboard
+	mapInfo       downloader.MapInfo
+	hooks         []hook.Result
+	hooksDone     bool
+	started       bool
+	jobs          jobList
+	ticking       bool
 	downloader    *downloader.DownLoader
 	helpTextStyle func(str string) string
 }
 
-func (m *model) Init() tea.Cmd {
-	ti := textinput.NewModel()
-	ti.Focus()
-	ti.Width = 180
-	ti.Placeholder = "eyJ0eXBlIjoiMCIsIm..."
+type tickMsg time.Time
+
+type estimateMsg struct {
+	estimate *downloader.SizeEstimate
+	spaceErr string
+}
+
+type eventsMsg []downloader.Event
+
+type finishedMsg struct {
+	started bool
+}
 
+type hooksMsg struct {
+	results []hook.Result
+	dbPath  string
+}
+
+func (m *model) Init() tea.Cmd {
 	s := spinner.NewModel()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 
 	m.state = 1
-	m.percent = 0.0
 	m.spinner = s
-	m.textInput = ti
+	m.form = newForm()
 	m.progress, _ = progress.NewModel(progress.WithScaledGradient("#FF7CCB", "#FDFF8C"))
 	m.progress.Width = 70
 	m.helpTextStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#626262")).Render
 
-	//return tickCmd()
-	return spinner.Tick
+	return tea.Batch(spinner.Tick, textinput.Blink)
 }
 
 func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
-	if reflect.TypeOf(msg).String() == "tea.KeyMsg" {
-		mg := msg.(tea.KeyMsg)
-		if mg.Type == tea.KeyCtrlC || mg.Type == tea.KeyEsc {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyCtrlC || msg.Type == tea.KeyEsc {
 			return m, tea.Quit
-		} else if mg.Type == tea.KeyEnter {
+		} else if m.state == 1 && (msg.Type == tea.KeyCtrlA || msg.Type == tea.KeyCtrlL) {
+			return m, m.showJobs(msg.Type == tea.KeyCtrlA)
+		} else if m.state == 6 {
+			if msg.Type == tea.KeyRunes && string(msg.Runes) == "n" {
+				m.state = 1
+				return m, nil
+			}
+			return m, m.jobs.Update(msg)
+		} else if msg.Type == tea.KeyEnter {
 			switch m.state {
 			case 1:
-				m.state = 1
-				m.preDownload()
+				return m, m.submitForm()
 			case 2:
 				m.state = 1
 			case 3:
-				m.state = 4
-				go m.runDownload()
+				if m.blocked() {
+					return m, nil
+				}
+				if !m.estimated {
+					m.queued = true
+					return m, nil
+				}
+				return m, m.startDownload()
 			case 5:
 				return m, tea.Quit
-			default:
-				return m, nil
 			}
 			return m, nil
-		} else {
-			text, cmd := m.textInput.Update(msg)
-			m.textInput = text
-			return m, cmd
+		} else if m.state == 1 {
+			return m, m.form.Update(msg)
+		}
+		return m, nil
+	case estimateMsg:
+		m.estimate, m.spaceErr, m.estimated = msg.estimate, msg.spaceErr, true
+		if m.blocked() {
+			m.queued = false
+		} else if m.queued {
+			return m, m.startDownload()
+		}
+		return m, nil
+	case tickMsg:
+		switch m.state {
+		case 4:
+			m.dashboard.sample(m.downloader, time.Time(msg))
+		case 6:
+			m.jobs.refresh()
+		default:
+			m.ticking = false
+			return m, nil
+		}
+		return m, tickCmd()
+	case queueIdleMsg:
+		return m, m.jobs.idle(msg)
+	case eventsMsg:
+		for _, e := range msg {
+			m.dashboard.event(e)
+		}
+		if msg == nil {
+			return m, nil
+		}
+		return m, waitEvents(m.events, m.eventsDone)
+	case finishedMsg:
+		// the listener may still be sending, so events stays open
+		m.unsubscribe()
+		close(m.eventsDone)
+		m.dashboard.sample(m.downloader, time.Now())
+		m.state = 5
+		m.started = msg.started
+		if !m.started {
+			// Start refused to run, there is no database to hand to the hooks
+			m.hooks, m.hooksDone = nil, true
+			return m, nil
 		}
+		return m, runHooks(m.mapInfo, m.dashboard.progress)
+	case hooksMsg:
+		m.hooks, m.hooksDone, m.mapInfo.DbPath = msg.results, true, msg.dbPath
+		return m, nil
 	}
+	formCmd := m.form.Update(msg)
 	m.spinner, cmd = m.spinner.Update(msg)
-	return m, cmd
+	return m, tea.Batch(cmd, formCmd)
 }
 
-func (m *model) preDownload() {
-	if mi, err := base64.StdEncoding.DecodeString(m.textInput.Value()); err != nil {
-		m.err = "Configuration analysis failed ( base64 )"
-		m.state = 2
-		return
-	} else {
-		mapInfo := downloader.MapInfo{}
-		if err := json.Unmarshal(mi, &mapInfo); err != nil {
-			m.err = "Configuration analysis failed ( json unmarshal )"
-			m.state = 2
-			return
+func (m *model) submitForm() tea.Cmd {
+	if config := m.form.value(fieldConfig); config != "" {
+		if info, err := m.decodeConfig(config); err != nil {
+			m.form.fields[fieldConfig].err = err.Error()
 		} else {
-			mapInfo.DbPath = "./mapTiles.db"
-			m.downloader = downloader.NewDownLoader(mapInfo, 4096, 4096, 512)
-			m.tilesCount = m.downloader.GetTaskInfo()
-			m.state = 3
+			m.form.load(info)
+			return m.form.setFocus(fieldOut)
 		}
+		return nil
 	}
+	if info, err := m.form.mapInfo(); err == nil {
+		return m.preDownload(info)
+	}
+	return nil
 }
 
-func (m *model) runDownload() {
-	go m.downloader.Start()
-	for {
-		time.Sleep(time.Millisecond * 500)
-		m.percent, m.tilesDone, m.tilesErr = m.downloader.GetDownPercent()
-		if m.percent >= float64(1) {
-			m.state = 5
+func (m *model) decodeConfig(str string) (downloader.MapInfo, error) {
+	var key []byte
+	if v, ok := downloader.Secret(config.CONFIG_KEY); ok {
+		key = []byte(v)
+	}
+	return downloader.DecodeMapInfo(str, key)
+}
+
+func (m *model) preDownload(mapInfo downloader.MapInfo) tea.Cmd {
+	m.mapInfo = mapInfo
+	m.downloader = downloader.NewDownLoader(mapInfo, 4096, 4096, 512)
+	// log lines would be drawn over the screen; failures show on the dashboard
+	m.downloader.SetLog(ioutil.Discard)
+	m.tilesCount = m.downloader.GetTaskInfo()
+	if m.tilesCount == 0 {
+		m.err = "No tiles in the selected area"
+		m.state = 2
+		return nil
+	}
+	m.estimate, m.spaceErr, m.estimated, m.queued = nil, "", false, false
+	m.state = 3
+	return estimateSize(m.downloader)
+}
+
+func estimateSize(dl *downloader.DownLoader) tea.Cmd {
+	return func() tea.Msg {
+		msg := estimateMsg{}
+		if estimate, err := dl.EstimateSize(config.SAMPLE_SIZE); err == nil {
+			msg.estimate = &estimate
+		}
+		if err := dl.Preflight(); err != nil {
+			msg.spaceErr = err.Error()
+		}
+		return msg
+	}
+}
+
+// startDownload runs the download as a command; the dashboard follows it
+// through tick and event messages.
+func (m *model) startDownload() tea.Cmd {
+	m.state = 4
+	m.dashboard = newDashboard()
+	m.events = make(chan downloader.Event, 1024)
+	m.eventsDone = make(chan struct{})
+	events := m.events
+	m.unsubscribe = m.downloader.Subscribe(func(e downloader.Event) {
+		if e.Type == downloader.TileDone {
 			return
 		}
+		select {
+		case events <- e:
+		default:
+		}
+	})
+	dl := m.downloader
+	download := func() tea.Msg {
+		return finishedMsg{dl.Start()}
+	}
+	return tea.Batch(download, waitEvents(events, m.eventsDone), m.tick())
+}
+
+// showJobs switches to the job list, first queueing the form when add is
+// set.
+func (m *model) showJobs(add bool) tea.Cmd {
+	if add {
+		info, err := m.form.mapInfo()
+		if err != nil {
+			return nil
+		}
+		err = m.jobs.add(info)
+		if err != nil {
+			m.err = err.Error()
+			m.state = 2
+			return nil
+		}
+	} else if err := m.jobs.open(); err != nil {
+		m.err = err.Error()
+		m.state = 2
+		return nil
+	}
+	m.state = 6
+	return tea.Batch(m.jobs.run(), m.tick())
+}
+
+// tick starts the tick loop unless it is already running.
+func (m *model) tick() tea.Cmd {
+	if m.ticking {
+		return nil
+	}
+	m.ticking = true
+	return tickCmd()
+}
+
+func runHooks(info downloader.MapInfo, p downloader.Progress) tea.Cmd {
+	return func() tea.Msg {
+		summary := &hook.Summary{DbPath: info.DbPath, Info: info, Progress: p}
+		results := hook.Run(config.HOOKS, summary)
+		return hooksMsg{results, summary.DbPath}
+	}
+}
+
+// waitEvents blocks for the next event and returns it with any others
+// already queued. Once done is closed it returns what is left, then nil.
+func waitEvents(events chan downloader.Event, done chan struct{}) tea.Cmd {
+	return func() tea.Msg {
+		var msg eventsMsg
+		select {
+		case e := <-events:
+			msg = eventsMsg{e}
+		case <-done:
+		}
+		for {
+			select {
+			case e := <-events:
+				msg = append(msg, e)
+			default:
+				return msg
+			}
+		}
 	}
 }
 
@@ -130,20 +313,22 @@ func (m *model) View() (str string) {
 	str = "MapDownloader " + config.VERSION + "\n\n"
 	switch m.state {
 	case 1:
-		str += "Enter the configuration string from the website <map.lizhengtech.com> \n\n" +
-			m.textInput.View() + "\n\n"
+		str += "Choose what to download, or paste a configuration string from <map.lizhengtech.com>\n\n" +
+			m.form.View() + "\n" +
+			m.helpTextStyle("tab/↑↓ move  ←→ choose  enter start  ctrl+a add to queue  ctrl+l jobs") + "\n"
 	case 2:
 		str += "err: " + m.err + "\n\n"
 	case 3:
-		str += " Guage Size: " + bytefmt.ByteSize(uint64(m.tilesCount*1024*15)) + "\n" +
-			"Tiles Count: " + strconv.Itoa(m.tilesCount) + "\n\n" +
-			"Press Enter Start Download ..." + "\n\n"
+		str += " Guage Size: " + m.sizeView() + "\n" +
+			"Tiles Count: " + strconv.Itoa(m.tilesCount) + "\n\n" + m.spaceView() +
+			m.startView() + "\n\n"
 	case 4:
-		str += m.spinner.View() + " Processing...   " +
-			fmt.Sprintf("total: %d   done: %d  timeout: %d", m.tilesCount, m.tilesDone, m.tilesErr) +
-			"\n\n" + m.progress.View(m.percent) + "\n\n"
+		str += m.spinner.View() + " Processing...   " + m.dashboard.View(m.progress)
 	case 5:
-		str += "download successful \n\n upload : oss cp /root/mapTools/mapTiles.db oss://lz-map/ \n\n   url: https://lz-map.oss-cn-shenzhen.aliyuncs.com/mapTiles.db \n\n"
+		str += m.finishedView()
+	case 6:
+		str += "Jobs (" + config.QUEUE_DB + ")\n\n" + m.jobs.View() +
+			m.helpTextStyle("↑↓ select  r retry  d delete  n new job") + "\n"
 	default:
 		return fmt.Sprintf("err")
 	}
@@ -151,8 +336,71 @@ func (m *model) View() (str string) {
 	return
 }
 
+func (m *model) finishedView() string {
+	p := m.dashboard.progress
+	if !m.started {
+		return fieldErrStyle.Render("download did not start") + "\n\n" + m.spaceView()
+	}
+	str := fmt.Sprintf("download finished: %d done, %d failed in %s\n\n   db: %s\n\n",
+		p.Done, p.Failed, p.Elapsed.Round(time.Second), m.mapInfo.DbPath)
+	switch {
+	case !m.hooksDone && len(config.HOOKS) != 0:
+		return str + m.spinner.View() + " running post-download actions ...\n\n"
+	case len(m.hooks) == 0:
+		return str + m.helpTextStyle("no post-download actions configured (config.HOOKS)") + "\n\n"
+	}
+	for _, r := range m.hooks {
+		if r.Err != nil {
+			str += fieldErrStyle.Render("✗ "+r.String()) + "\n"
+		} else {
+			str += "✓ " + r.String() + m.helpTextStyle(fmt.Sprintf("  (%s)", r.Elapsed.Round(time.Millisecond))) + "\n"
+		}
+	}
+	return str + "\n"
+}
+
+// blocked reports whether the pre-flight check failed in strict mode, so
+// Start would refuse to run.
+func (m *model) blocked() bool {
+	return m.estimated && m.spaceErr != "" && config.DISK_STRICT
+}
+
+func (m *model) startView() string {
+	if m.blocked() {
+		return "Free some disk space or choose another output, then restart"
+	}
+	if m.queued {
+		return "Download starts when sampling finishes ..."
+	}
+	return "Press Enter Start Download ..."
+}
+
+func (m *model) sizeView() string {
+	if !m.estimated {
+		return "sampling tiles ..."
+	}
+	if m.estimate == nil {
+		return "~" + bytefmt.ByteSize(uint64(m.tilesCount*config.TILE_SIZE)) + " (sampling failed)"
+	}
+	return fmt.Sprintf("%s (95%%: %s - %s, %d tiles sampled)", bytefmt.ByteSize(uint64(m.estimate.Bytes)),
+		bytefmt.ByteSize(uint64(m.estimate.Low)), bytefmt.ByteSize(uint64(m.estimate.High)), m.estimate.Sampled)
+}
+
+func (m *model) spaceView() string {
+	if !m.estimated {
+		return ""
+	}
+	if m.spaceErr == "" {
+		return ""
+	}
+	if config.DISK_STRICT {
+		return "Disk: " + m.spaceErr + ", download will not start\n\n"
+	}
+	return "Disk: " + m.spaceErr + "\n\n"
+}
+
 func tickCmd() tea.Cmd {
 	return tea.Tick(time.Millisecond*200, func(t time.Time) tea.Msg {
-		return time.Time(t)
+		return tickMsg(t)
 	})
 }
@@ -10,4 +10,5 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/robertkrimen/otto v0.0.0-20210614181706-373ff5438452
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,25 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Free returns the bytes available to unprivileged users on the filesystem
+// holding path, which may not exist yet.
+func Free(path string) (uint64, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return free(dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return free(dir)
+		}
+		dir = parent
+	}
+}
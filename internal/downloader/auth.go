@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mapdownloader/config"
+	"net/http"
+	"os"
+)
+
+type secrets map[string]string
+
+func loadSecrets() (secrets, error) {
+	path := os.Getenv(config.SECRETS_ENV)
+	if path == "" {
+		path = config.SECRETS_FILE
+	}
+	s := secrets{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s secrets) lookup(name string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := s[name]
+	return v, ok
+}
+
+func (s secrets) expand(str string, missing *[]string) string {
+	return os.Expand(str, func(name string) string {
+		v, ok := s.lookup(name)
+		if !ok && missing != nil {
+			for _, known := range *missing {
+				if known == name {
+					return ""
+				}
+			}
+			*missing = append(*missing, name)
+		}
+		return v
+	})
+}
+
+func (dl *DownLoader) SetProviderAuth(tileType int, auth config.ProviderAuth) {
+	if dl.auth == nil {
+		dl.auth = make(map[int]config.ProviderAuth)
+	}
+	dl.auth[tileType] = auth
+}
+
+func (dl *DownLoader) resolveProvider() []string {
+	missing := make([]string, 0)
+	provider := make(map[int]string, len(dl.provider))
+	for k, v := range dl.provider {
+		provider[k] = dl.secrets.expand(v, &missing)
+	}
+	dl.provider = provider
+
+	mirror := make(map[int][]string, len(dl.mirror))
+	for k, v := range dl.mirror {
+		for _, m := range v {
+			mirror[k] = append(mirror[k], dl.secrets.expand(m, &missing))
+		}
+	}
+	dl.mirror = mirror
+
+	auth := make(map[int]config.ProviderAuth, len(dl.auth))
+	for k, v := range dl.auth {
+		a := config.ProviderAuth{
+			Referer:  dl.secrets.expand(v.Referer, &missing),
+			Bearer:   dl.secrets.expand(v.Bearer, &missing),
+			Username: dl.secrets.expand(v.Username, &missing),
+			Password: dl.secrets.expand(v.Password, &missing),
+			Cookies:  v.Cookies,
+			Header:   make(map[string]string, len(v.Header)),
+		}
+		for hk, hv := range v.Header {
+			a.Header[hk] = dl.secrets.expand(hv, &missing)
+		}
+		auth[k] = a
+	}
+	dl.auth = auth
+	return missing
+}
+
+func (dl *DownLoader) setHeader(req *http.Request, tileType int) {
+	for k, v := range config.DEFAULT_HEADER {
+		req.Header.Set(k, v)
+	}
+	auth, ok := dl.auth[tileType]
+	if !ok {
+		return
+	}
+	if auth.Referer != "" {
+		req.Header.Set("Referer", auth.Referer)
+	}
+	if auth.Bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.Bearer)
+	} else if auth.Username != "" || auth.Password != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	for k, v := range auth.Header {
+		req.Header.Set(k, v)
+	}
+}
+
+func (dl *DownLoader) needCookies() bool {
+	for _, v := range dl.auth {
+		if v.Cookies {
+			return true
+		}
+	}
+	return false
+}
+
+// Secret looks name up in the environment, then in the secrets file.
+func Secret(name string) (string, bool) {
+	s, _ := loadSecrets()
+	return s.lookup(name)
+}
+
+// ExpandSecrets resolves $NAME and ${NAME} in str and returns the names
+// that were not found.
+func ExpandSecrets(str string) (string, []string) {
+	missing := make([]string, 0)
+	s, _ := loadSecrets()
+	return s.expand(str, &missing), missing
+}
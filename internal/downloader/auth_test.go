@@ -0,0 +1,21 @@
+package downloader
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSecretsExpand(t *testing.T) {
+	os.Setenv("AUTH_TEST_ENV", "from-env")
+	defer os.Unsetenv("AUTH_TEST_ENV")
+	s := secrets{"AUTH_TEST_FILE": "from-file", "AUTH_TEST_ENV": "shadowed"}
+	missing := make([]string, 0)
+	got := s.expand("$AUTH_TEST_ENV/${AUTH_TEST_FILE}/${AUTH_TEST_NONE}/$AUTH_TEST_NONE/$AUTH_TEST_GONE", &missing)
+	if got != "from-env/from-file///" {
+		t.Fatalf("expanded to %q", got)
+	}
+	if want := []string{"AUTH_TEST_NONE", "AUTH_TEST_GONE"}; !reflect.DeepEqual(missing, want) {
+		t.Fatalf("missing %v, want each name once: %v", missing, want)
+	}
+}
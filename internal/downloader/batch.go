@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"database/sql"
+)
+
+// batch commits every size rows so a crash loses at most one batch and
+// readers are not blocked by a transaction spanning the whole job.
+type batch struct {
+	db      *sql.DB
+	size    int
+	queries []string
+	tx      *sql.Tx
+	stmts   []*sql.Stmt
+	rows    int
+}
+
+func newBatch(db *sql.DB, size int, queries ...string) *batch {
+	if size < 1 {
+		size = 1
+	}
+	return &batch{db: db, size: size, queries: queries}
+}
+
+func (b *batch) stmt(i int) (*sql.Stmt, error) {
+	if b.tx == nil {
+		tx, err := b.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		stmts := make([]*sql.Stmt, len(b.queries))
+		for j, query := range b.queries {
+			if stmts[j], err = tx.Prepare(query); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		b.tx, b.stmts = tx, stmts
+	}
+	return b.stmts[i], nil
+}
+
+func (b *batch) add() error {
+	b.rows++
+	if b.rows < b.size {
+		return nil
+	}
+	return b.commit()
+}
+
+func (b *batch) commit() error {
+	if b.tx == nil {
+		return nil
+	}
+	tx := b.tx
+	b.tx, b.stmts, b.rows = nil, nil, 0
+	return tx.Commit()
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/disk"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+var ErrLowSpace = errors.New("not enough free disk space")
+
+// Preflight checks that the estimated size of the task, from EstimateSize
+// or config.TILE_SIZE per tile, plus config.MIN_FREE_SPACE fits next to
+// DbPath. Unless the task appends, the current database counts as free
+// since Start replaces it; an append keeps it and only adds the new tiles.
+func (dl *DownLoader) Preflight() error {
+	need := atomic.LoadInt64(&dl.sized)
+	if need == 0 {
+		need = int64(len(dl.jobs)) * int64(config.TILE_SIZE)
+	}
+	free, err := disk.Free(dl.mapInfo.DbPath)
+	if err != nil {
+		dl.logln("disk err", err)
+		return nil
+	}
+	if info, err := os.Stat(dl.mapInfo.DbPath); err == nil && !dl.mapInfo.Append {
+		free += uint64(info.Size())
+	}
+	if uint64(need)+uint64(config.MIN_FREE_SPACE) > free {
+		return fmt.Errorf("%w: need %s plus %s reserve, %s free", ErrLowSpace,
+			bytefmt.ByteSize(uint64(need)), bytefmt.ByteSize(uint64(config.MIN_FREE_SPACE)), bytefmt.ByteSize(free))
+	}
+	return nil
+}
+
+// watchDisk pauses downloads while free space is below config.MIN_FREE_SPACE
+// and asks the writer to commit what it has, so nothing is left half written
+// when the disk fills up.
+func (dl *DownLoader) watchDisk(stop, flush chan struct{}) {
+	ticker := time.NewTicker(time.Duration(config.DISK_CHECK) * time.Second)
+	defer ticker.Stop()
+	defer dl.lowSpace.open()
+	for {
+		if stopped(stop) {
+			return
+		}
+		free, err := disk.Free(dl.mapInfo.DbPath)
+		if err == nil && free < uint64(config.MIN_FREE_SPACE) {
+			if dl.lowSpace.close() {
+				dl.logln("disk err", ErrLowSpace, bytefmt.ByteSize(free), "free, pausing")
+				dl.emit(Event{Type: Paused, Err: ErrLowSpace})
+				select {
+				case flush <- struct{}{}:
+				case <-stop:
+					return
+				}
+			}
+		} else if err == nil && dl.lowSpace.open() {
+			dl.emit(Event{Type: Resumed})
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
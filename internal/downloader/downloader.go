@@ -2,14 +2,20 @@ package downloader
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mapdownloader/config"
+	"mapdownloader/internal/limiter"
 	"mapdownloader/internal/pool"
+	"mapdownloader/internal/proxy"
 	"net/http"
+	"net/http/cookiejar"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -18,23 +24,47 @@ import (
 
 type Tile struct {
 	Count       int
+	TilesID     int64
 	TilesType   int
 	TilesCol    string
 	TilesRow    string
 	TilesLevel  string
+	TilesSource string
+	TilesETag   string
+	TilesMod    string
+	TilesVer    string
 	TilesBinary []byte
 }
 
+var errNotModified = errors.New("tile not modified")
+
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return "http status " + strconv.Itoa(e.Code)
+}
+
 type MapInfo struct {
-	Type     int `json:"type"`
-	MinZ     int `json:"minZ"`
-	MaxZ     int `json:"maxZ"`
-	DbPath   string
-	MinLng   string `json:"minLng"`
-	MaxLng   string `json:"maxLng"`
-	MinLat   string `json:"minLat"`
-	MaxLat   string `json:"maxLat"`
-	Language string `json:"lang"`
+	Type      int `json:"type"`
+	MinZ      int `json:"minZ"`
+	MaxZ      int `json:"maxZ"`
+	DbPath    string
+	MinLng    string `json:"minLng"`
+	MaxLng    string `json:"maxLng"`
+	MinLat    string `json:"minLat"`
+	MaxLat    string `json:"maxLat"`
+	Language  string `json:"lang"`
+	Order     string `json:"order"`
+	CenterLng string `json:"centerLng"`
+	CenterLat string `json:"centerLat"`
+	// Polygon narrows the bbox to the tiles touching an outline given as
+	// "lng,lat;lng,lat;...", see ParsePolygon.
+	Polygon string `json:"polygon,omitempty"`
+	// Append keeps the tiles and tasks already in DbPath, skips the tiles it
+	// has and records this job as another task row.
+	Append bool `json:"append"`
 }
 
 type DownLoader struct {
@@ -43,15 +73,37 @@ type DownLoader struct {
 	jsVM      *otto.Otto
 	mapInfo   MapInfo
 	provider  map[int]string
+	mirror    map[int][]string
+	auth      map[int]config.ProviderAuth
+	secrets   secrets
 	netClient *http.Client
+	jarClient *http.Client
+	limiter   *limiter.Limiter
+	bandwidth *limiter.Bandwidth
+	proxies   *proxy.Pool
 
 	capPipe   int
 	capQueue  int
 	maxWorker int
 
-	errTiles   int
-	doneTiles  int
-	totalTiles int
+	progress atomic.Value
+	pool     atomic.Value // *pool.Dispatcher of the running download
+	events   events
+	paused   gate
+	lowSpace gate
+	sized    int64
+
+	log      io.Writer
+	warnings []string
+}
+
+type TileError struct {
+	Tile Tile
+	Err  error
+}
+
+func (e *TileError) Error() string {
+	return fmt.Sprintf("tile %s/%s/%s: %v", e.Tile.TilesLevel, e.Tile.TilesRow, e.Tile.TilesCol, e.Err)
 }
 
 func NewDownLoader(info MapInfo, capPipe, capQueue, maxWorker int) *DownLoader {
@@ -60,23 +112,71 @@ func NewDownLoader(info MapInfo, capPipe, capQueue, maxWorker int) *DownLoader {
 
 	client := &http.Client{}
 	client.Transport = &http.Transport{
+		Proxy:               proxy.FromRequest,
 		MaxIdleConnsPerHost: 5000,
 	}
 	client.Timeout = time.Duration(20) * time.Second
 
+	auth := make(map[int]config.ProviderAuth, len(config.PROVIDER_AUTH))
+	for k, v := range config.PROVIDER_AUTH {
+		auth[k] = v
+	}
+
+	// reported by prepare, once the caller had a chance to call SetLog
+	warnings := make([]string, 0)
+	var bandwidth *limiter.Bandwidth
+	if schedule, err := limiter.ParseSchedule(config.BANDWIDTH_SCHEDULE); err != nil {
+		warnings = append(warnings, fmt.Sprint("bandwidth schedule err ", err))
+	} else if len(schedule.Windows) != 0 || schedule.Default != limiter.Unlimited {
+		bandwidth = limiter.NewBandwidth(schedule)
+	}
+
+	proxies := config.PROXIES
+	if len(proxies) == 0 && os.Getenv(config.PROXY_ENV) != "" {
+		proxies = strings.Split(os.Getenv(config.PROXY_ENV), ",")
+	}
+	proxyPool, err := proxy.NewPool(proxies, config.PROXY_MAX_FAILS, time.Duration(config.PROXY_COOLDOWN)*time.Second)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprint("proxy err ", err))
+	}
+
 	return &DownLoader{
-		jobs:       make([]Tile, 0),
-		jsVM:       vm,
-		mapInfo:    info,
-		netClient:  client,
-		totalTiles: 0,
-		capPipe:    capPipe,
-		capQueue:   capQueue,
-		maxWorker:  maxWorker,
+		jobs:      make([]Tile, 0),
+		jsVM:      vm,
+		mapInfo:   info,
+		auth:      auth,
+		netClient: client,
+		limiter:   limiter.NewLimiter(config.HOST_RATE, config.HOST_BURST),
+		bandwidth: bandwidth,
+		proxies:   proxyPool,
+		capPipe:   capPipe,
+		capQueue:  capQueue,
+		maxWorker: maxWorker,
+		log:       os.Stdout,
+		warnings:  warnings,
 	}
 }
 
+// SetLog sends the log lines of dl to w instead of stdout.
+func (dl *DownLoader) SetLog(w io.Writer) {
+	dl.log = w
+}
+
+func (dl *DownLoader) logln(a ...interface{}) {
+	fmt.Fprintln(dl.log, a...)
+}
+
 func (dl *DownLoader) GetTaskInfo() int {
+	jobs := dl.taskTiles()
+	if err := dl.orderTiles(jobs); err != nil {
+		dl.logln("order tiles err", err)
+	}
+	dl.jobs = jobs
+	dl.progress.Store(newCounters(jobs))
+	return len(jobs)
+}
+
+func (dl *DownLoader) taskTiles() []Tile {
 	jobs := make([]Tile, 0)
 	if dl.mapInfo.Type == 0 {
 		jobs = dl.getTilesList(0)
@@ -86,76 +186,210 @@ func (dl *DownLoader) GetTaskInfo() int {
 	} else {
 		jobs = dl.getTilesList(0)
 	}
-	dl.jobs = jobs
-	dl.totalTiles = len(jobs)
-	return dl.totalTiles
+	return jobs
+}
+
+func (dl *DownLoader) SetRateLimit(rate float64, burst int) {
+	dl.limiter = limiter.NewLimiter(rate, burst)
+}
+
+func (dl *DownLoader) GetRate() map[string]float64 {
+	return dl.limiter.Rates()
+}
+
+func (dl *DownLoader) SetSchedule(spec string) error {
+	schedule, err := limiter.ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	dl.bandwidth = limiter.NewBandwidth(schedule)
+	return nil
+}
+
+func (dl *DownLoader) GetBandwidth() int64 {
+	return dl.bandwidth.Rate()
+}
+
+func (dl *DownLoader) SetProxies(proxies []string) error {
+	pool, err := proxy.NewPool(proxies, config.PROXY_MAX_FAILS, time.Duration(config.PROXY_COOLDOWN)*time.Second)
+	if err != nil {
+		return err
+	}
+	dl.proxies = pool
+	return nil
 }
 
-func (dl *DownLoader) GetDownPercent() (float64, int, int) {
-	return float64(dl.doneTiles+dl.errTiles) / float64(dl.totalTiles), dl.doneTiles, dl.errTiles
+func (dl *DownLoader) GetProxies() (alive, total int) {
+	return dl.proxies.Alive()
 }
 
 func (dl *DownLoader) Start() bool {
-	if dl.totalTiles == 0 {
+	if len(dl.jobs) == 0 {
+		dl.emitFinished()
 		return false
 	}
-	if dl.mapInfo.Language == "zh" {
-		dl.provider = config.PROVIDER_CN
-	} else {
-		dl.provider = config.PROVIDER_EN
+	if err := dl.Preflight(); err != nil {
+		dl.logln("disk err", err)
+		if config.DISK_STRICT {
+			dl.emitFinished()
+			return false
+		}
 	}
+	dl.prepare()
 	dl.initDB()
-	dl.cleanDB()
+	if !dl.mapInfo.Append {
+		dl.cleanDB()
+	} else if err := dl.skipStored(); err != nil {
+		dl.logln("append err", err)
+	}
 
 	tilesPipe := make(chan Tile, dl.capPipe)
-	done := make(chan bool)
+	errPipe := make(chan error, dl.capPipe)
+	flush := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- dl.saveTiles(tilesPipe, errPipe, flush)
+	}()
 
-	pool := pool.NewDispatcher(dl.maxWorker, dl.capQueue)
-	pool.Run()
+	pool := dl.runPool(func(err error) {
+		errPipe <- err
+	})
 
-	go dl.saveTiles(tilesPipe, done)
+	stop := make(chan struct{})
+	watchers := dl.watch(stop, flush)
+	dl.counters().begin()
 	for _, v := range dl.jobs {
 		tile := v
-		job := func() {
-			var err error
-			url := strings.Replace(dl.provider[tile.TilesType], "{x}", tile.TilesRow, 1)
-			url = strings.Replace(url, "{y}", tile.TilesCol, 1)
-			url = strings.Replace(url, "{z}", tile.TilesLevel, 1)
-			if tile.TilesBinary, err = dl.getTileBinary(url); err != nil {
-				fmt.Println("download tile err", err)
-				dl.errTiles++
-			} else {
-				tilesPipe <- tile
+		job := func() error {
+			if err := dl.fetchTile(&tile, false); err != nil {
+				return &TileError{tile, err}
 			}
+			tilesPipe <- tile
+			return nil
 		}
-		pool.JobQueue <- job
+		pool.SubmitErr(job)
 	}
-	<-done
+	pool.Wait()
+	pool.Stop()
+	close(stop)
+	watchers.Wait()
+	close(tilesPipe)
+	close(errPipe)
+	if err := <-done; err != nil {
+		dl.logln("saveTile err", err)
+	}
+	dl.counters().finish()
 	dl.setTask()
 	dl.db.Exec(config.CreateIndex)
 	dl.db.Close()
+	dl.emitFinished()
 	return true
 }
 
-func (dl *DownLoader) saveTiles(pipe chan Tile, done chan bool) {
-	tx, _ := dl.db.Begin()
-	stmt, _ := tx.Prepare("INSERT INTO map(zoom_level,tile_column,tile_row,tile_type,tile_data) values(?,?,?,?,?);")
-	defer tx.Commit()
-	for {
+func (dl *DownLoader) runPool(onError func(err error)) *pool.Dispatcher {
+	workers := dl.maxWorker
+	if config.AUTO_TUNE && workers > config.MIN_WORKER*2 {
+		workers = config.MIN_WORKER * 2
+	}
+	p := pool.NewDispatcher(workers, dl.capQueue)
+	p.OnError = onError
+	p.Run()
+	if config.AUTO_TUNE {
+		p.AutoTune(config.MIN_WORKER, dl.maxWorker, time.Duration(config.TUNE_INTERVAL)*time.Second)
+	}
+	dl.pool.Store(p)
+	return p
+}
+
+func (dl *DownLoader) GetWorkers() int {
+	p, _ := dl.pool.Load().(*pool.Dispatcher)
+	if p == nil {
+		return 0
+	}
+	return p.Workers()
+}
+
+// GetActive returns the number of tile requests in flight.
+func (dl *DownLoader) GetActive() int {
+	p, _ := dl.pool.Load().(*pool.Dispatcher)
+	if p == nil {
+		return 0
+	}
+	return p.Active()
+}
+
+func (dl *DownLoader) prepare() {
+	if dl.mapInfo.Language == "zh" {
+		dl.provider = config.PROVIDER_CN
+		dl.mergeMirror(config.MIRROR_CN)
+	} else {
+		dl.provider = config.PROVIDER_EN
+		dl.mergeMirror(config.MIRROR_EN)
+	}
+	for _, w := range dl.warnings {
+		dl.logln(w)
+	}
+	dl.warnings = nil
+	var err error
+	if dl.secrets, err = loadSecrets(); err != nil {
+		dl.logln("secrets err", err)
+	}
+	if missing := dl.resolveProvider(); len(missing) != 0 {
+		dl.logln("missing secrets", strings.Join(missing, ","))
+	}
+	if dl.needCookies() {
+		jar, _ := cookiejar.New(nil)
+		dl.jarClient = &http.Client{Transport: dl.netClient.Transport, Timeout: dl.netClient.Timeout, Jar: jar}
+	}
+}
+
+func (dl *DownLoader) saveTiles(pipe chan Tile, errs chan error, flush chan struct{}) error {
+	progress := dl.counters()
+	writer := newBatch(dl.db, config.SAVE_BATCH, "INSERT INTO map(zoom_level,tile_column,tile_row,tile_type,tile_data,tile_source,tile_etag,tile_modified,fetched_at,source_version) values(?,?,?,?,?,?,?,?,?,?);")
+	for pipe != nil || errs != nil {
 		select {
-		case ti := <-pipe:
-			if _, err := stmt.Exec(ti.TilesLevel, ti.TilesCol, ti.TilesRow, ti.TilesType, ti.TilesBinary); err != nil {
-				fmt.Println("saveTile err", err)
-			} else {
-				dl.doneTiles++
+		case ti, ok := <-pipe:
+			if !ok {
+				pipe = nil
+				continue
+			}
+			stmt, err := writer.stmt(0)
+			if err == nil {
+				_, err = stmt.Exec(ti.TilesLevel, ti.TilesCol, ti.TilesRow, ti.TilesType, ti.TilesBinary, ti.TilesSource, ti.TilesETag, ti.TilesMod, time.Now().Unix(), ti.TilesVer)
 			}
-		default:
-			if (dl.doneTiles+dl.errTiles) == dl.totalTiles && dl.doneTiles != 0 {
-				done <- true
-				return
+			if err != nil {
+				dl.logln("saveTile err", err)
+				dl.emitTile(TileFailed, ti, err, progress.addFailed(ti))
+				continue
+			}
+			dl.emitTile(TileDone, ti, nil, progress.addDone(ti))
+			if err := writer.add(); err != nil {
+				dl.logln("saveTile err", err)
+			}
+		case <-flush:
+			if err := writer.commit(); err != nil {
+				dl.logln("saveTile err", err)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if p, ok := err.(*pool.PanicError); ok {
+				dl.logln("download tile err", p, "\n"+string(p.Stack))
+				atomic.AddInt64(&progress.failed, 1)
+				dl.emit(Event{Type: TileFailed, Err: err})
+			} else if e, ok := err.(*TileError); ok {
+				dl.logln("download tile err", e)
+				dl.emitTile(TileFailed, e.Tile, e.Err, progress.addFailed(e.Tile))
+			} else {
+				dl.logln("download tile err", err)
+				atomic.AddInt64(&progress.failed, 1)
+				dl.emit(Event{Type: TileFailed, Err: err})
 			}
 		}
 	}
+	return writer.commit()
 }
 
 func (dl *DownLoader) initDB() {
@@ -165,13 +399,50 @@ func (dl *DownLoader) initDB() {
 		dl.db.Exec(config.TileTable)
 		dl.db.Exec(config.TaskTable)
 	}
+	dl.migrateDB("map", config.TILE_COLUMNS)
+	dl.migrateDB("task", config.TASK_COLUMNS)
+}
+
+func (dl *DownLoader) migrateDB(table string, columns []string) {
+	existing, err := dl.tableColumns("main", table)
+	if err != nil {
+		dl.logln("migrate err", err)
+		return
+	}
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		if existing[name] {
+			continue
+		}
+		if _, err := dl.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column); err != nil {
+			dl.logln("migrate err", err)
+		}
+	}
+}
+
+func (dl *DownLoader) tableColumns(schema, table string) (map[string]bool, error) {
+	rows, err := dl.db.Query("PRAGMA " + schema + ".table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var def sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err == nil {
+			columns[name] = true
+		}
+	}
+	return columns, rows.Err()
 }
 
 func (dl *DownLoader) cleanDB() {
 	var err error
 	clean := func(query string) {
 		if err != nil {
-			fmt.Println("clean err")
+			dl.logln("clean err")
 			return
 		}
 		_, err = dl.db.Exec(query)
@@ -184,10 +455,59 @@ func (dl *DownLoader) cleanDB() {
 	clean("VACUUM")
 }
 
+// skipStored drops the jobs whose tile the database already has and counts
+// them as skipped.
+func (dl *DownLoader) skipStored() error {
+	rows, err := dl.db.Query("SELECT zoom_level,tile_column,tile_row,tile_type FROM map WHERE zoom_level BETWEEN ? AND ?", dl.mapInfo.MinZ, dl.mapInfo.MaxZ)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool)
+	for rows.Next() {
+		t := Tile{}
+		if err := rows.Scan(&t.TilesLevel, &t.TilesCol, &t.TilesRow, &t.TilesType); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[tileKey(t)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	progress := dl.counters()
+	jobs := make([]Tile, 0, len(dl.jobs))
+	for _, t := range dl.jobs {
+		if !stored[tileKey(t)] {
+			jobs = append(jobs, t)
+		} else if progress.addSkipped(t) {
+			dl.emitZoom(t)
+		}
+	}
+	dl.jobs = jobs
+	return nil
+}
+
 func (dl *DownLoader) setTask() {
-	date := time.Now().Format("2006-01-02 15:04:05")
-	stmt, _ := dl.db.Prepare("INSERT INTO task(id,type,count,version,language,date,maxLevel,minLevel) values(?,?,?,?,?,?,?,?);")
-	stmt.Exec(1, dl.mapInfo.Type, dl.totalTiles-dl.errTiles, config.VERSION, dl.mapInfo.Language, date, dl.mapInfo.MaxZ, dl.mapInfo.MinZ)
+	p := dl.Progress()
+	if err := dl.saveTask(Task{MapInfo: dl.mapInfo, Count: p.Done, Failed: p.Failed, Skipped: p.Skipped}); err != nil {
+		dl.logln("save task err", err)
+	}
+}
+
+// saveTask adds t as the next task row; rows keep the date they were
+// first written with.
+func (dl *DownLoader) saveTask(t Task) error {
+	if t.Date == "" {
+		t.Date = time.Now().Format("2006-01-02 15:04:05")
+	}
+	if t.Version == "" {
+		t.Version = config.VERSION
+	}
+	_, err := dl.db.Exec("INSERT INTO task(id,type,count,version,language,date,maxLevel,minLevel,minLng,maxLng,minLat,maxLat,polygon,failed,skipped) "+
+		"SELECT IFNULL(MAX(CAST(id AS INTEGER)),0)+1,?,?,?,?,?,?,?,?,?,?,?,?,?,? FROM task;",
+		t.Type, t.Count, t.Version, t.Language, t.Date, t.MaxZ, t.MinZ, t.MinLng, t.MaxLng, t.MinLat, t.MaxLat, t.Polygon, t.Failed, t.Skipped)
+	return err
 }
 
 func (dl *DownLoader) getTilesList(mapType int) []Tile {
@@ -195,8 +515,12 @@ func (dl *DownLoader) getTilesList(mapType int) []Tile {
 	for z := dl.mapInfo.MinZ; z <= dl.mapInfo.MaxZ; z++ {
 		minX, minY := dl.getTilesCoordinate(dl.mapInfo.MinLng, dl.mapInfo.MinLat, z)
 		maxX, maxY := dl.getTilesCoordinate(dl.mapInfo.MaxLng, dl.mapInfo.MaxLat, z)
+		inside := dl.polygonFilter(z)
 		for i := minX; i <= maxX; i++ {
 			for j := minY; j <= maxY; j++ {
+				if inside != nil && !inside(i, j) {
+					continue
+				}
 				jobs = append(jobs, Tile{
 					TilesRow:   strconv.Itoa(i),
 					TilesCol:   strconv.Itoa(j),
@@ -220,27 +544,78 @@ func (dl *DownLoader) getTilesCoordinate(lng, lat string, z int) (x, y int) {
 	return
 }
 
-func (dl *DownLoader) getTileBinary(url string) ([]byte, error) {
+func (dl *DownLoader) getTileBinary(url string, tile *Tile, conditional bool) ([]byte, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
-	req.Header.Add("Accept-Encoding", "gzip, deflate")
-	req.Header.Add("Accept-Language", "zh,en-US;q=0.9,en;q=0.8,zh-CN;q=0.7")
-	req.Header.Add("Cache-Control", "max-age=0")
-	req.Header.Add("Connection", "Keep-Alive")
-	req.Header.Add("Upgrade-Insecure-Requests", "1")
-	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.125 Safari/537.36")
-	resp, err := dl.netClient.Do(req)
+	dl.setHeader(req, tile.TilesType)
+	if conditional && tile.TilesETag != "" {
+		req.Header.Set("If-None-Match", tile.TilesETag)
+	}
+	if conditional && tile.TilesMod != "" {
+		req.Header.Set("If-Modified-Since", tile.TilesMod)
+	}
+	client := dl.netClient
+	if dl.jarClient != nil && dl.auth[tile.TilesType].Cookies {
+		client = dl.jarClient
+	}
+	bucket := dl.limiter.Bucket(req.URL.Host)
+	dl.paused.wait()
+	dl.lowSpace.wait()
+	dl.bandwidth.Wait()
+	bucket.Wait()
+	proxyURL := dl.proxies.Next()
+	if proxyURL != nil {
+		req = req.WithContext(proxy.WithProxy(req.Context(), proxyURL))
+	}
+	resp, err := client.Do(req)
 	if err != nil {
+		dl.proxies.Report(proxyURL, err)
 		return nil, err
 	}
 	defer resp.Body.Close()
-	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		dl.proxies.Report(proxyURL, &StatusError{resp.StatusCode})
+		return nil, &StatusError{resp.StatusCode}
+	}
+	dl.proxies.Report(proxyURL, nil)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		bucket.Backoff(retryAfter(resp.Header.Get("Retry-After"), time.Now()))
+		return nil, &StatusError{resp.StatusCode}
+	}
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		bucket.Recover()
+		return nil, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{resp.StatusCode}
+	}
+	bucket.Recover()
+	data, err := ioutil.ReadAll(dl.bandwidth.Reader(resp.Body))
+	if err == nil {
+		tile.TilesETag = resp.Header.Get("ETag")
+		tile.TilesMod = resp.Header.Get("Last-Modified")
+	}
 	return data, err
 }
 
+// retryAfter reads a Retry-After header, given in seconds or as an HTTP
+// date.
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
 func (dl *DownLoader) exists(path string) bool {
 	if _, err := os.Stat(path); err != nil {
 		return os.IsExist(err)
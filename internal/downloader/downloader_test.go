@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mapdownloader/config"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tileServer serves a small png for every tile, or 404 when fail says so,
+// and points the zh providers at it for the rest of the test.
+func tileServer(t *testing.T, fail func(r *http.Request) bool) *httptest.Server {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail != nil && fail(r) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	provider, mirror := config.PROVIDER_CN, config.MIRROR_CN
+	config.PROVIDER_CN = map[int]string{
+		0: srv.URL + "/0/{z}/{x}/{y}",
+		1: srv.URL + "/1/{z}/{x}/{y}",
+		2: srv.URL + "/2/{z}/{x}/{y}",
+	}
+	config.MIRROR_CN = map[int][]string{}
+	t.Cleanup(func() {
+		srv.Close()
+		config.PROVIDER_CN, config.MIRROR_CN = provider, mirror
+	})
+	return srv
+}
+
+// testInfo covers 4, 4 and 6 roadmap tiles at zoom 10, 11 and 12.
+func testInfo(t *testing.T) MapInfo {
+	return MapInfo{
+		Type:     0,
+		MinZ:     10,
+		MaxZ:     12,
+		DbPath:   filepath.Join(t.TempDir(), "tiles.db"),
+		MinLng:   "116.30",
+		MaxLng:   "116.50",
+		MinLat:   "39.97",
+		MaxLat:   "39.90",
+		Language: "zh",
+	}
+}
+
+func TestStartRepeatedNoLeak(t *testing.T) {
+	tileServer(t, nil)
+	info := testInfo(t)
+	run := func() {
+		dl := NewDownLoader(info, 16, 16, 8)
+		if dl.GetTaskInfo() == 0 {
+			t.Fatal("no tiles")
+		}
+		if !dl.Start() {
+			t.Fatal("download did not start")
+		}
+		if p := dl.Progress(); p.Done != p.Total {
+			t.Fatalf("%d of %d tiles done", p.Done, p.Total)
+		}
+		dl.netClient.CloseIdleConnections()
+	}
+	run()
+	base := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		run()
+	}
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > base; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > base {
+		t.Fatalf("%d goroutines after repeated downloads, %d after the first", n, base)
+	}
+}
+
+// TestWorkersWhileDownloading polls the pool getters the way the CLI
+// reporter and the TUI dashboard do while Start runs; go test -race catches
+// unsynchronized access to the pool.
+func TestWorkersWhileDownloading(t *testing.T) {
+	tileServer(t, nil)
+	dl := NewDownLoader(testInfo(t), 16, 16, 8)
+	dl.GetTaskInfo()
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		most := 0
+		for {
+			select {
+			case <-done:
+				polled <- most
+				return
+			default:
+			}
+			if w := dl.GetWorkers(); w > most {
+				most = w
+			}
+			if a := dl.GetActive(); a < 0 || a > 8 {
+				t.Errorf("%d active requests with 8 workers", a)
+			}
+			dl.GetRate()
+			dl.GetBandwidth()
+			dl.GetProxies()
+		}
+	}()
+	if !dl.Start() {
+		t.Fatal("download did not start")
+	}
+	close(done)
+	if most := <-polled; most == 0 {
+		t.Fatal("never saw the pool while downloading")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Mon, 01 Mar 2021 08:00:30 GMT", 30 * time.Second},
+		{"Monday, 01-Mar-21 08:01:00 GMT", time.Minute},
+		{"Mon Mar  1 08:00:05 2021", 5 * time.Second},
+		// already passed
+		{"Mon, 01 Mar 2021 07:59:00 GMT", 0},
+		{"soon", 0},
+	} {
+		if got := retryAfter(c.value, now); got != c.want {
+			t.Errorf("Retry-After %q: %v, want %v", c.value, got, c.want)
+		}
+	}
+}
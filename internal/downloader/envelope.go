@@ -0,0 +1,203 @@
+package downloader
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mapdownloader/config"
+	"strconv"
+	"strings"
+)
+
+const mercatorLat = 85.05112878
+
+var (
+	ErrChecksum  = errors.New("config checksum mismatch, the string is damaged or incomplete")
+	ErrSignature = errors.New("config signature invalid, the string was not issued by the portal")
+	ErrUnsigned  = errors.New("config is not signed")
+)
+
+// envelope wraps the MapInfo json of a config string. Sum is the hex sha256
+// of Payload and Sig its hex HMAC-SHA256 under the portal key.
+type envelope struct {
+	Version int             `json:"v"`
+	Payload json.RawMessage `json:"payload"`
+	Sum     string          `json:"sum"`
+	Sig     string          `json:"sig,omitempty"`
+}
+
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// EncodeMapInfo returns the base64 config string of info, signed when key
+// is not empty.
+func EncodeMapInfo(info MapInfo, key []byte) (string, error) {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	env := envelope{Version: config.CONFIG_VERSION, Payload: payload, Sum: hex.EncodeToString(sum[:])}
+	if len(key) != 0 {
+		env.Sig = sign(payload, key)
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeMapInfo checks and decodes a config string. Bare MapInfo json from
+// before the envelope is accepted while config.CONFIG_LEGACY is set and no
+// key is required.
+func DecodeMapInfo(str string, key []byte) (MapInfo, error) {
+	info := MapInfo{}
+	data, err := decodeBase64(str)
+	if err != nil {
+		return info, fmt.Errorf("config is not valid base64")
+	}
+	env := envelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return info, fmt.Errorf("config is not valid json")
+	}
+
+	payload := []byte(env.Payload)
+	if env.Version == 0 && len(payload) == 0 {
+		if !config.CONFIG_LEGACY || len(key) != 0 {
+			return info, ErrUnsigned
+		}
+		payload = data
+	} else {
+		if env.Version > config.CONFIG_VERSION {
+			return info, fmt.Errorf("config version %d is newer than supported version %d, please upgrade", env.Version, config.CONFIG_VERSION)
+		}
+		sum := sha256.Sum256(payload)
+		if !strings.EqualFold(env.Sum, hex.EncodeToString(sum[:])) {
+			return info, ErrChecksum
+		}
+		if len(key) != 0 {
+			if env.Sig == "" {
+				return info, ErrUnsigned
+			}
+			if !hmac.Equal([]byte(strings.ToLower(env.Sig)), []byte(sign(payload, key))) {
+				return info, ErrSignature
+			}
+		}
+	}
+
+	if err := json.Unmarshal(payload, &info); err != nil {
+		return info, fmt.Errorf("config payload: %v", err)
+	}
+	return info, info.Validate()
+}
+
+func decodeBase64(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		var data []byte
+		if data, err = enc.DecodeString(str); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func sign(payload, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validate reports the first field of m that cannot be downloaded. MinLat is
+// the north edge and MaxLat the south edge, as sent by the portal.
+func (m MapInfo) Validate() error {
+	known := false
+	for _, layer := range config.LAYERS {
+		known = known || layer == m.Type
+	}
+	if !known {
+		return &FieldError{"type", fmt.Sprintf("unknown map type %d", m.Type)}
+	}
+	if m.MinZ < 0 || m.MinZ > 22 {
+		return &FieldError{"minZ", fmt.Sprintf("%d is outside 0..22", m.MinZ)}
+	}
+	if m.MaxZ < 0 || m.MaxZ > 22 {
+		return &FieldError{"maxZ", fmt.Sprintf("%d is outside 0..22", m.MaxZ)}
+	}
+	if m.MinZ > m.MaxZ {
+		return &FieldError{"minZ", fmt.Sprintf("%d is greater than maxZ %d", m.MinZ, m.MaxZ)}
+	}
+	minLng, err := coordinate("minLng", m.MinLng, 180, true)
+	if err != nil {
+		return err
+	}
+	maxLng, err := coordinate("maxLng", m.MaxLng, 180, true)
+	if err != nil {
+		return err
+	}
+	minLat, err := coordinate("minLat", m.MinLat, mercatorLat, true)
+	if err != nil {
+		return err
+	}
+	maxLat, err := coordinate("maxLat", m.MaxLat, mercatorLat, true)
+	if err != nil {
+		return err
+	}
+	if minLng > maxLng {
+		return &FieldError{"minLng", fmt.Sprintf("%s is east of maxLng %s", m.MinLng, m.MaxLng)}
+	}
+	if minLat < maxLat {
+		return &FieldError{"minLat", fmt.Sprintf("%s is south of maxLat %s, minLat is the north edge", m.MinLat, m.MaxLat)}
+	}
+	if m.Polygon != "" {
+		if _, err := ParsePolygon(m.Polygon); err != nil {
+			return &FieldError{"polygon", err.Error()}
+		}
+	}
+	if _, err := coordinate("centerLng", m.CenterLng, 180, false); err != nil {
+		return err
+	}
+	if _, err := coordinate("centerLat", m.CenterLat, mercatorLat, false); err != nil {
+		return err
+	}
+	switch m.Language {
+	case "", "zh", "en":
+	default:
+		return &FieldError{"lang", fmt.Sprintf("unknown language %q, expected zh or en", m.Language)}
+	}
+	switch m.Order {
+	case "", OrderScan, OrderZoom, OrderSpiral, OrderHilbert:
+	default:
+		return &FieldError{"order", fmt.Sprintf("unknown order %q", m.Order)}
+	}
+	return nil
+}
+
+func coordinate(field, value string, limit float64, required bool) (float64, error) {
+	if value == "" {
+		if required {
+			return 0, &FieldError{field, "is required"}
+		}
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, &FieldError{field, fmt.Sprintf("%q is not a number", value)}
+	}
+	if v < -limit || v > limit {
+		return 0, &FieldError{field, fmt.Sprintf("%s is outside -%g..%g", value, limit, limit)}
+	}
+	return v, nil
+}
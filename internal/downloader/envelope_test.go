@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// reseal decodes the config string str, lets change edit the envelope and
+// encodes it again.
+func reseal(t *testing.T, str string, change func(env *envelope)) string {
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := envelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	change(&env)
+	if data, err = json.Marshal(env); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestMapInfoEnvelope(t *testing.T) {
+	info := testInfo(t)
+	info.DbPath = ""
+	info.CenterLng, info.CenterLat = "116.41", "39.93"
+	key := []byte("portal key")
+	signed, err := EncodeMapInfo(info, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := EncodeMapInfo(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(env *envelope) {
+		env.Payload = json.RawMessage(strings.Replace(string(env.Payload), `"maxZ":12`, `"maxZ":18`, 1))
+	}
+
+	for _, e := range []struct {
+		name string
+		str  string
+		key  []byte
+		err  error
+	}{
+		{"signed", signed, key, nil},
+		{"signed without a key set", signed, nil, nil},
+		{"unsigned", unsigned, nil, nil},
+		{"unsigned with a key set", unsigned, key, ErrUnsigned},
+		{"signature removed", reseal(t, signed, func(env *envelope) { env.Sig = "" }), key, ErrUnsigned},
+		{"wrong key", signed, []byte("other key"), ErrSignature},
+		{"modified payload", reseal(t, signed, modify), nil, ErrChecksum},
+		{"modified payload with a new sum", reseal(t, signed, func(env *envelope) {
+			modify(env)
+			sum := sha256.Sum256(env.Payload)
+			env.Sum = hex.EncodeToString(sum[:])
+		}), key, ErrSignature},
+	} {
+		got, err := DecodeMapInfo(e.str, e.key)
+		if e.err != nil {
+			if !errors.Is(err, e.err) {
+				t.Errorf("%s: err %v, want %v", e.name, err, e.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+		} else if got != info {
+			t.Errorf("%s: got %+v, want %+v", e.name, got, info)
+		}
+	}
+	if _, err := DecodeMapInfo(signed[:len(signed)/2], nil); err == nil {
+		t.Error("decoded a truncated config")
+	}
+}
+
+func TestMapInfoEnvelopeLegacy(t *testing.T) {
+	info := testInfo(t)
+	info.DbPath = ""
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.StdEncoding.EncodeToString(data)
+	if got, err := DecodeMapInfo(legacy, nil); err != nil || got != info {
+		t.Fatalf("legacy config: %+v, %v", got, err)
+	}
+	if _, err := DecodeMapInfo(legacy, []byte("portal key")); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("legacy config with a key set: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package downloader
+
+import (
+	"fmt"
+	"mapdownloader/config"
+	"mapdownloader/internal/pool"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// z of the two sided 95% confidence interval
+const confidenceZ = 1.96
+
+type LayerEstimate struct {
+	Zoom    int
+	Type    int
+	Tiles   int64
+	Bytes   int64
+	Low     int64
+	High    int64
+	Sampled int
+}
+
+type SizeEstimate struct {
+	Tiles   int64
+	Bytes   int64
+	Low     int64
+	High    int64
+	Sampled int
+	Failed  int
+	Layers  []LayerEstimate
+}
+
+func (e SizeEstimate) String() string {
+	return fmt.Sprintf("%d tiles, %d bytes (95%%: %d-%d, %d samples, %d failed)", e.Tiles, e.Bytes, e.Low, e.High, e.Sampled, e.Failed)
+}
+
+// Estimate returns the tiles per zoom and tile type of the task prepared by
+// GetTaskInfo, assuming config.TILE_SIZE bytes per tile.
+func (dl *DownLoader) Estimate() []LayerEstimate {
+	return estimateTiles(dl.jobs)
+}
+
+func estimateTiles(tiles []Tile) []LayerEstimate {
+	index := make(map[[2]int]int)
+	estimates := make([]LayerEstimate, 0)
+	for _, t := range tiles {
+		z, _ := zoomOf(t)
+		key := [2]int{z, t.TilesType}
+		i, ok := index[key]
+		if !ok {
+			i = len(estimates)
+			index[key] = i
+			estimates = append(estimates, LayerEstimate{Zoom: z, Type: t.TilesType})
+		}
+		estimates[i].Tiles++
+		estimates[i].Bytes += int64(config.TILE_SIZE)
+	}
+	for i := range estimates {
+		estimates[i].Low, estimates[i].High = estimates[i].Bytes, estimates[i].Bytes
+	}
+	sort.Slice(estimates, func(i, j int) bool {
+		if estimates[i].Zoom != estimates[j].Zoom {
+			return estimates[i].Zoom < estimates[j].Zoom
+		}
+		return estimates[i].Type < estimates[j].Type
+	})
+	return estimates
+}
+
+// EstimateSize downloads up to perLayer random tiles of every zoom and tile
+// type of the task and extrapolates the total size. Strata whose samples all
+// fail borrow the mean of the other zooms of the same type.
+func (dl *DownLoader) EstimateSize(perLayer int) (SizeEstimate, error) {
+	if len(dl.jobs) == 0 {
+		return SizeEstimate{}, fmt.Errorf("no tiles, call GetTaskInfo first")
+	}
+	if perLayer < 1 {
+		perLayer = 1
+	}
+	dl.prepare()
+
+	strata := make(map[[2]int][]Tile)
+	for _, t := range dl.jobs {
+		z, _ := zoomOf(t)
+		key := [2]int{z, t.TilesType}
+		strata[key] = append(strata[key], t)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var mu sync.Mutex
+	sizes := make(map[[2]int][]float64)
+	failed := 0
+	p := pool.NewDispatcher(config.SAMPLE_WORKERS, config.SAMPLE_WORKERS)
+	p.Run()
+	for key, tiles := range strata {
+		key := key
+		for _, i := range random.Perm(len(tiles))[:minInt(perLayer, len(tiles))] {
+			tile := tiles[i]
+			p.Submit(func() {
+				err := dl.fetchTile(&tile, false)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed++
+					return
+				}
+				sizes[key] = append(sizes[key], float64(len(tile.TilesBinary)))
+			})
+		}
+	}
+	p.Wait()
+	p.Stop()
+
+	typeMeans := make(map[int][]float64)
+	for key, s := range sizes {
+		mean, _ := meanVar(s)
+		typeMeans[key[1]] = append(typeMeans[key[1]], mean)
+	}
+
+	estimate := SizeEstimate{Failed: failed}
+	var variance float64
+	for _, layer := range estimateTiles(dl.jobs) {
+		key := [2]int{layer.Zoom, layer.Type}
+		s := sizes[key]
+		n, total := float64(len(s)), float64(layer.Tiles)
+		mean, sampleVar := meanVar(s)
+		switch {
+		case len(s) == 0 && len(typeMeans[layer.Type]) != 0:
+			// nothing to go on but the other zooms: widen by their spread
+			mean, sampleVar = meanVar(typeMeans[layer.Type])
+			n = 1
+		case len(s) == 0:
+			mean, sampleVar, n = float64(config.TILE_SIZE), 0, 1
+		}
+		layerVar := 0.0
+		if total > n {
+			// finite population correction, exact when every tile was sampled
+			layerVar = total * total * sampleVar / n * (1 - n/total)
+		}
+		layer.Sampled = len(s)
+		layer.Bytes = int64(total * mean)
+		margin := confidenceZ * math.Sqrt(layerVar)
+		layer.Low = int64(math.Max(0, total*mean-margin))
+		layer.High = int64(total*mean + margin)
+
+		estimate.Tiles += layer.Tiles
+		estimate.Bytes += layer.Bytes
+		estimate.Sampled += layer.Sampled
+		estimate.Layers = append(estimate.Layers, layer)
+		variance += layerVar
+	}
+	margin := confidenceZ * math.Sqrt(variance)
+	estimate.Low = int64(math.Max(0, float64(estimate.Bytes)-margin))
+	estimate.High = int64(float64(estimate.Bytes) + margin)
+	if estimate.Sampled == 0 {
+		return estimate, fmt.Errorf("all %d sample downloads failed", failed)
+	}
+	atomic.StoreInt64(&dl.sized, estimate.Bytes)
+	return estimate, nil
+}
+
+func meanVar(values []float64) (mean, variance float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(values)-1)
+}
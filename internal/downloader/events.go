@@ -0,0 +1,207 @@
+package downloader
+
+import (
+	"mapdownloader/internal/limiter"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	TileDone EventType = iota
+	TileFailed
+	ZoomCompleted
+	Paused
+	Resumed
+	Finished
+)
+
+var eventNames = map[EventType]string{
+	TileDone:      "tile_done",
+	TileFailed:    "tile_failed",
+	ZoomCompleted: "zoom_completed",
+	Paused:        "paused",
+	Resumed:       "resumed",
+	Finished:      "finished",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Tile     *Tile
+	Zoom     int
+	Err      error
+	Progress *Progress
+}
+
+// Listener is called synchronously; tile events come from the single
+// writer goroutine, lifecycle events from whichever goroutine caused them.
+type Listener func(Event)
+
+type events struct {
+	mu        sync.RWMutex
+	next      int
+	listeners map[int]Listener
+}
+
+func (dl *DownLoader) Subscribe(l Listener) (unsubscribe func()) {
+	dl.events.mu.Lock()
+	defer dl.events.mu.Unlock()
+	if dl.events.listeners == nil {
+		dl.events.listeners = make(map[int]Listener)
+	}
+	id := dl.events.next
+	dl.events.next++
+	dl.events.listeners[id] = l
+	return func() {
+		dl.events.mu.Lock()
+		delete(dl.events.listeners, id)
+		dl.events.mu.Unlock()
+	}
+}
+
+// emit calls the listeners without holding the lock, so a listener may
+// unsubscribe itself. Each listener is looked up again right before its
+// call, so none is called once its unsubscribe has returned; a call that
+// already started may still be running.
+func (dl *DownLoader) emit(e Event) {
+	dl.events.mu.RLock()
+	ids := make([]int, 0, len(dl.events.listeners))
+	for id := range dl.events.listeners {
+		ids = append(ids, id)
+	}
+	dl.events.mu.RUnlock()
+	if len(ids) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, id := range ids {
+		dl.events.mu.RLock()
+		l, ok := dl.events.listeners[id]
+		dl.events.mu.RUnlock()
+		if ok {
+			l(e)
+		}
+	}
+}
+
+func (dl *DownLoader) emitTile(t EventType, tile Tile, err error, zoomDone bool) {
+	dl.emit(Event{Type: t, Tile: &tile, Err: err})
+	if zoomDone {
+		dl.emitZoom(tile)
+	}
+}
+
+func (dl *DownLoader) emitZoom(tile Tile) {
+	p := dl.Progress()
+	z, _ := zoomOf(tile)
+	dl.emit(Event{Type: ZoomCompleted, Zoom: z, Progress: &p})
+}
+
+func (dl *DownLoader) emitFinished() {
+	p := dl.Progress()
+	dl.emit(Event{Type: Finished, Progress: &p})
+}
+
+type gate struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (g *gate) close() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ch != nil {
+		return false
+	}
+	g.ch = make(chan struct{})
+	return true
+}
+
+func (g *gate) open() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ch == nil {
+		return false
+	}
+	close(g.ch)
+	g.ch = nil
+	return true
+}
+
+func (g *gate) wait() {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+func (dl *DownLoader) Pause() {
+	if dl.paused.close() {
+		dl.emit(Event{Type: Paused})
+	}
+}
+
+func (dl *DownLoader) Resume() {
+	if dl.paused.open() {
+		dl.emit(Event{Type: Resumed})
+	}
+}
+
+// watch runs the schedule and disk watchers until stop is closed; wait on
+// the result before emitting Finished so no Paused or Resumed follows it.
+func (dl *DownLoader) watch(stop, flush chan struct{}) *sync.WaitGroup {
+	watchers := &sync.WaitGroup{}
+	watchers.Add(2)
+	go func() {
+		defer watchers.Done()
+		dl.watchSchedule(stop)
+	}()
+	go func() {
+		defer watchers.Done()
+		dl.watchDisk(stop, flush)
+	}()
+	return watchers
+}
+
+func (dl *DownLoader) watchSchedule(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	paused := false
+	for {
+		if stopped(stop) {
+			return
+		}
+		if now := dl.bandwidth.Rate() == limiter.Paused; now != paused {
+			paused = now
+			if paused {
+				dl.emit(Event{Type: Paused})
+			} else {
+				dl.emit(Event{Type: Resumed})
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopped reports whether stop is closed; select picks at random between a
+// tick and stop, so watchers check before they emit.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"mapdownloader/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenerUnsubscribesItself(t *testing.T) {
+	dl := NewDownLoader(MapInfo{}, 1, 1, 1)
+	calls := 0
+	var unsubscribe func()
+	unsubscribe = dl.Subscribe(func(e Event) {
+		calls++
+		unsubscribe()
+	})
+	done := make(chan struct{})
+	go func() {
+		dl.Pause()
+		dl.Resume()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pause deadlocked on a listener that unsubscribed itself")
+	}
+	if calls != 1 {
+		t.Fatalf("listener called %d times, want 1", calls)
+	}
+}
+
+func TestWatchersStopQuietly(t *testing.T) {
+	dl := NewDownLoader(MapInfo{DbPath: filepath.Join(t.TempDir(), "tiles.db")}, 1, 1, 1)
+	if err := dl.SetSchedule("pause"); err != nil {
+		t.Fatal(err)
+	}
+	free := config.MIN_FREE_SPACE
+	config.MIN_FREE_SPACE = 1 << 62
+	defer func() { config.MIN_FREE_SPACE = free }()
+	var events []Event
+	dl.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+
+	stop := make(chan struct{})
+	close(stop)
+	dl.watchSchedule(stop)
+	dl.watchDisk(stop, make(chan struct{}))
+	if len(events) != 0 {
+		t.Fatalf("stopped watchers emitted %v", events)
+	}
+}
@@ -0,0 +1,274 @@
+package downloader
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"mapdownloader/config"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ExportMBTiles = "mbtiles"
+	ExportDir     = "dir"
+)
+
+type MergeReport struct {
+	Added   int64
+	Skipped int64
+}
+
+func (r MergeReport) String() string {
+	return fmt.Sprintf("added: %d  skipped: %d", r.Added, r.Skipped)
+}
+
+// Export writes the tiles of one tile type either as a standard MBTiles file
+// (TMS rows) or as a z/x/y directory tree.
+func (dl *DownLoader) Export(format, out string, tileType int) (int64, error) {
+	if err := dl.openDB(); err != nil {
+		return 0, err
+	}
+	defer dl.db.Close()
+	if _, err := dl.loadTask(); err != nil {
+		return 0, err
+	}
+	rows, err := dl.db.Query("SELECT zoom_level,tile_row,tile_column,tile_data FROM map WHERE tile_type = ? ORDER BY zoom_level", tileType)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var write func(z, x, y int, data []byte) error
+	var finish func() error
+	switch format {
+	case ExportMBTiles:
+		if dl.exists(out) {
+			return 0, fmt.Errorf("%s already exists", out)
+		}
+		mb, err := sql.Open("sqlite3", out)
+		if err != nil {
+			return 0, err
+		}
+		defer mb.Close()
+		if _, err := mb.Exec("CREATE TABLE metadata (name TEXT, value TEXT); CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB); CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);"); err != nil {
+			return 0, err
+		}
+		writer := newBatch(mb, config.SAVE_BATCH, "INSERT OR REPLACE INTO tiles(zoom_level,tile_column,tile_row,tile_data) values(?,?,?,?)")
+		imageFormat := ""
+		write = func(z, x, y int, data []byte) error {
+			if imageFormat == "" {
+				imageFormat = tileFormat(data)
+			}
+			stmt, err := writer.stmt(0)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(z, x, (1<<uint(z))-1-y, data); err != nil {
+				return err
+			}
+			return writer.add()
+		}
+		finish = func() error {
+			if err := writer.commit(); err != nil {
+				return err
+			}
+			return dl.writeMetadata(mb, out, imageFormat, tileType)
+		}
+	case ExportDir:
+		write = func(z, x, y int, data []byte) error {
+			dir := filepath.Join(out, strconv.Itoa(z), strconv.Itoa(x))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(y)+"."+tileFormat(data)), data, 0644)
+		}
+		finish = func() error {
+			return nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	var count int64
+	for rows.Next() {
+		var z, x, y int
+		var data []byte
+		if err := rows.Scan(&z, &x, &y, &data); err != nil {
+			return count, err
+		}
+		if err := write(z, x, y, data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, finish()
+}
+
+func (dl *DownLoader) writeMetadata(mb *sql.DB, out, imageFormat string, tileType int) error {
+	name := strings.TrimSuffix(filepath.Base(out), filepath.Ext(out))
+	layer := "baselayer"
+	if tileType == 2 {
+		layer = "overlay"
+	}
+	metadata := map[string]string{
+		"name":        name,
+		"description": config.TILE_TYPES[tileType],
+		"format":      imageFormat,
+		"type":        layer,
+		"version":     "1.1",
+	}
+	var minZ, maxZ sql.NullInt64
+	dl.db.QueryRow("SELECT MIN(zoom_level),MAX(zoom_level) FROM map WHERE tile_type = ?", tileType).Scan(&minZ, &maxZ)
+	if minZ.Valid {
+		metadata["minzoom"] = strconv.FormatInt(minZ.Int64, 10)
+		metadata["maxzoom"] = strconv.FormatInt(maxZ.Int64, 10)
+	}
+	if dl.hasRegion() {
+		west, _ := strconv.ParseFloat(dl.mapInfo.MinLng, 64)
+		east, _ := strconv.ParseFloat(dl.mapInfo.MaxLng, 64)
+		north, _ := strconv.ParseFloat(dl.mapInfo.MinLat, 64)
+		south, _ := strconv.ParseFloat(dl.mapInfo.MaxLat, 64)
+		metadata["bounds"] = fmt.Sprintf("%g,%g,%g,%g", math.Min(west, east), math.Min(north, south), math.Max(west, east), math.Max(north, south))
+	}
+	for k, v := range metadata {
+		if _, err := mb.Exec("INSERT INTO metadata(name,value) values(?,?)", k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tileFormat(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	case "image/gif":
+		return "gif"
+	}
+	return "png"
+}
+
+// Merge copies tiles from sources that dl's database does not have yet and
+// appends the task rows of each source.
+func (dl *DownLoader) Merge(sources ...string) (MergeReport, error) {
+	report := MergeReport{}
+	for _, src := range sources {
+		if !dl.exists(src) {
+			return report, fmt.Errorf("database %s not found", src)
+		}
+	}
+	dl.initDB()
+	defer dl.db.Close()
+	// ATTACH only applies to the connection it runs on.
+	dl.db.SetMaxOpenConns(1)
+	if _, err := dl.db.Exec(config.CreateIndex); err != nil {
+		return report, err
+	}
+	for _, src := range sources {
+		if _, err := dl.db.Exec("ATTACH DATABASE ? AS src", src); err != nil {
+			return report, err
+		}
+		added, skipped, tasks, err := dl.mergeSource()
+		dl.db.Exec("DETACH DATABASE src")
+		if err != nil {
+			return report, fmt.Errorf("%s: %v", src, err)
+		}
+		report.Added += added
+		report.Skipped += skipped
+		for _, t := range tasks {
+			if err := dl.mergeTaskRow(t); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// mergeTaskRow appends t unless a task with the same date, layer, zooms,
+// bbox and polygon is already recorded, as when a source is merged twice.
+func (dl *DownLoader) mergeTaskRow(t Task) error {
+	var n int
+	err := dl.db.QueryRow("SELECT COUNT(*) FROM task WHERE IFNULL(date,'')=? AND IFNULL(type,0)=? AND IFNULL(minLevel,0)=? AND IFNULL(maxLevel,0)=? AND IFNULL(minLng,'')=? AND IFNULL(maxLng,'')=? AND IFNULL(minLat,'')=? AND IFNULL(maxLat,'')=? AND IFNULL(polygon,'')=?",
+		t.Date, t.Type, t.MinZ, t.MaxZ, t.MinLng, t.MaxLng, t.MinLat, t.MaxLat, t.Polygon).Scan(&n)
+	if err != nil || n != 0 {
+		return err
+	}
+	return dl.saveTask(t)
+}
+
+func (dl *DownLoader) mergeSource() (added, skipped int64, tasks []Task, err error) {
+	columns, err := dl.tableColumns("src", "map")
+	if err != nil {
+		return
+	}
+	names := []string{"zoom_level", "tile_column", "tile_row", "tile_type", "tile_data"}
+	values := []string{"s.zoom_level", "s.tile_column", "s.tile_row", "s.tile_type", "s.tile_data"}
+	for _, column := range config.TILE_COLUMNS {
+		name := strings.Fields(column)[0]
+		names = append(names, name)
+		if columns[name] {
+			values = append(values, "s."+name)
+		} else {
+			values = append(values, "NULL")
+		}
+	}
+	var total int64
+	if err = dl.db.QueryRow("SELECT COUNT(*) FROM src.map").Scan(&total); err != nil {
+		return
+	}
+	result, err := dl.db.Exec("INSERT INTO map(" + strings.Join(names, ",") + ") SELECT " + strings.Join(values, ",") +
+		" FROM src.map s WHERE NOT EXISTS (SELECT 1 FROM main.map m WHERE m.zoom_level = s.zoom_level AND m.tile_column = s.tile_column AND m.tile_row = s.tile_row AND m.tile_type = s.tile_type)")
+	if err != nil {
+		return
+	}
+	added, _ = result.RowsAffected()
+	skipped = total - added
+	tasks, err = dl.readTasks("src")
+	return
+}
+
+func mergeTask(a, b *Task) *Task {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := *a
+	merged.ID = ""
+	merged.Count += b.Count
+	merged.Failed += b.Failed
+	merged.Skipped += b.Skipped
+	merged.MinZ = minInt(a.MinZ, b.MinZ)
+	merged.MaxZ = maxInt(a.MaxZ, b.MaxZ)
+	// the combined bbox covers both outlines
+	if a.Polygon != b.Polygon {
+		merged.Polygon = ""
+	}
+	if a.MinLng == "" || b.MinLng == "" {
+		merged.MinLng, merged.MaxLng, merged.MinLat, merged.MaxLat = "", "", "", ""
+		return &merged
+	}
+	// MinLat is the north edge, MaxLat the south edge.
+	merged.MinLng = pickFloat(a.MinLng, b.MinLng, math.Min)
+	merged.MaxLng = pickFloat(a.MaxLng, b.MaxLng, math.Max)
+	merged.MinLat = pickFloat(a.MinLat, b.MinLat, math.Max)
+	merged.MaxLat = pickFloat(a.MaxLat, b.MaxLat, math.Min)
+	return &merged
+}
+
+func pickFloat(a, b string, pick func(x, y float64) float64) string {
+	fa, _ := strconv.ParseFloat(a, 64)
+	fb, _ := strconv.ParseFloat(b, 64)
+	return strconv.FormatFloat(pick(fa, fb), 'f', -1, 64)
+}
@@ -0,0 +1,287 @@
+package downloader
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"sort"
+	"strconv"
+)
+
+type Task struct {
+	MapInfo
+	ID      string
+	Count   int64
+	Failed  int64
+	Skipped int64
+	Version string
+	Date    string
+}
+
+type ZoomCoverage struct {
+	Zoom     int
+	Type     int
+	Tiles    int64
+	Expected int64
+	Bytes    int64
+	MinX     int
+	MaxX     int
+	MinY     int
+	MaxY     int
+}
+
+func (c ZoomCoverage) Coverage() float64 {
+	if c.Expected == 0 {
+		return 0
+	}
+	return float64(c.Tiles) / float64(c.Expected)
+}
+
+type Inspection struct {
+	Task  *Task
+	Tasks []Task
+	Tiles int64
+	Bytes int64
+	Zooms []ZoomCoverage
+}
+
+type VerifyReport struct {
+	Checked int64
+	Corrupt []Tile
+	Missing []Tile
+}
+
+func (r VerifyReport) String() string {
+	return fmt.Sprintf("checked: %d  corrupt: %d  missing: %d", r.Checked, len(r.Corrupt), len(r.Missing))
+}
+
+// openDB opens an existing database read-only and leaves its schema as it
+// is; readers cope with the columns older versions did not have.
+func (dl *DownLoader) openDB() error {
+	if !dl.exists(dl.mapInfo.DbPath) {
+		return fmt.Errorf("database %s not found", dl.mapInfo.DbPath)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dl.mapInfo.DbPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	dl.db = db
+	return nil
+}
+
+// loadTask reads the task rows and takes their combined zoom range, layer
+// and bbox as the MapInfo of dl.
+func (dl *DownLoader) loadTask() (*Task, error) {
+	return dl.readTask("main", true)
+}
+
+// Task returns the task rows of the database combined into one, nil when it
+// has none.
+func (dl *DownLoader) Task() (*Task, error) {
+	if err := dl.openDB(); err != nil {
+		return nil, err
+	}
+	defer dl.db.Close()
+	return dl.loadTask()
+}
+
+func (dl *DownLoader) readTask(schema string, apply bool) (*Task, error) {
+	tasks, err := dl.readTasks(schema)
+	if err != nil {
+		return nil, err
+	}
+	var t *Task
+	for i := range tasks {
+		t = mergeTask(t, &tasks[i])
+	}
+	if t != nil && apply {
+		t.DbPath = dl.mapInfo.DbPath
+		t.Order = dl.mapInfo.Order
+		dl.mapInfo = t.MapInfo
+	}
+	return t, nil
+}
+
+// readTasks returns every task row of schema, one per job written into the
+// database, oldest first.
+func (dl *DownLoader) readTasks(schema string) ([]Task, error) {
+	columns, err := dl.tableColumns(schema, "task")
+	if err != nil {
+		return nil, err
+	}
+	bbox := "'','','',''"
+	if columns["minLng"] {
+		bbox = "IFNULL(minLng,''),IFNULL(maxLng,''),IFNULL(minLat,''),IFNULL(maxLat,'')"
+	}
+	counts := "0,0"
+	if columns["failed"] {
+		counts = "IFNULL(failed,0),IFNULL(skipped,0)"
+	}
+	polygon := "''"
+	if columns["polygon"] {
+		polygon = "IFNULL(polygon,'')"
+	}
+	rows, err := dl.db.Query("SELECT IFNULL(id,''),IFNULL(type,0),IFNULL(count,0),IFNULL(version,''),IFNULL(language,''),IFNULL(date,''),IFNULL(minLevel,0),IFNULL(maxLevel,0)," +
+		bbox + "," + polygon + "," + counts + " FROM " + schema + ".task ORDER BY CAST(id AS INTEGER)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		t := Task{}
+		if err := rows.Scan(&t.ID, &t.Type, &t.Count, &t.Version, &t.Language, &t.Date, &t.MinZ, &t.MaxZ,
+			&t.MinLng, &t.MaxLng, &t.MinLat, &t.MaxLat, &t.Polygon, &t.Failed, &t.Skipped); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// tasksTiles lists the tiles of every task that recorded its bbox, once
+// each, and tells whether any task did.
+func (dl *DownLoader) tasksTiles(tasks []Task) ([]Tile, bool) {
+	info := dl.mapInfo
+	defer func() {
+		dl.mapInfo = info
+	}()
+	seen := make(map[string]bool)
+	tiles := make([]Tile, 0)
+	known := false
+	for _, t := range tasks {
+		dl.mapInfo = t.MapInfo
+		if !dl.hasRegion() {
+			continue
+		}
+		known = true
+		for _, tile := range dl.taskTiles() {
+			if key := tileKey(tile); !seen[key] {
+				seen[key] = true
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles, known
+}
+
+func (dl *DownLoader) hasRegion() bool {
+	return dl.mapInfo.MinLng != "" && dl.mapInfo.MaxLng != "" && dl.mapInfo.MinLat != "" && dl.mapInfo.MaxLat != ""
+}
+
+// Inspect summarises the task rows and the stored tiles per zoom and type;
+// Expected is only known when a task recorded its bbox.
+func (dl *DownLoader) Inspect() (Inspection, error) {
+	report := Inspection{}
+	if err := dl.openDB(); err != nil {
+		return report, err
+	}
+	defer dl.db.Close()
+	task, err := dl.loadTask()
+	if err != nil {
+		return report, err
+	}
+	report.Task = task
+	if report.Tasks, err = dl.readTasks("main"); err != nil {
+		return report, err
+	}
+
+	zooms := make(map[[2]int]*ZoomCoverage)
+	zoom := func(z, t int) *ZoomCoverage {
+		c, ok := zooms[[2]int{z, t}]
+		if !ok {
+			c = &ZoomCoverage{Zoom: z, Type: t}
+			zooms[[2]int{z, t}] = c
+		}
+		return c
+	}
+	rows, err := dl.db.Query("SELECT zoom_level,tile_type,COUNT(*),IFNULL(SUM(LENGTH(tile_data)),0),MIN(tile_row),MAX(tile_row),MIN(tile_column),MAX(tile_column) FROM map GROUP BY zoom_level,tile_type")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var z, t int
+		var tiles, size int64
+		var minX, maxX, minY, maxY int
+		if err := rows.Scan(&z, &t, &tiles, &size, &minX, &maxX, &minY, &maxY); err != nil {
+			rows.Close()
+			return report, err
+		}
+		c := zoom(z, t)
+		c.Tiles, c.Bytes = tiles, size
+		c.MinX, c.MaxX, c.MinY, c.MaxY = minX, maxX, minY, maxY
+		report.Tiles += tiles
+		report.Bytes += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	if tiles, ok := dl.tasksTiles(report.Tasks); ok {
+		for _, e := range estimateTiles(tiles) {
+			zoom(e.Zoom, e.Type).Expected = e.Tiles
+		}
+	}
+
+	for _, c := range zooms {
+		report.Zooms = append(report.Zooms, *c)
+	}
+	sort.Slice(report.Zooms, func(i, j int) bool {
+		if report.Zooms[i].Zoom != report.Zooms[j].Zoom {
+			return report.Zooms[i].Zoom < report.Zooms[j].Zoom
+		}
+		return report.Zooms[i].Type < report.Zooms[j].Type
+	})
+	return report, nil
+}
+
+// Verify decodes every stored tile and lists the tiles of the tasks with a
+// recorded bbox that are not stored.
+func (dl *DownLoader) Verify() (VerifyReport, error) {
+	report := VerifyReport{}
+	if err := dl.openDB(); err != nil {
+		return report, err
+	}
+	defer dl.db.Close()
+	tasks, err := dl.readTasks("main")
+	if err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]bool)
+	rows, err := dl.db.Query("SELECT tile_id,zoom_level,tile_column,tile_row,tile_type,tile_data FROM map")
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := Tile{}
+		var data []byte
+		if err := rows.Scan(&t.TilesID, &t.TilesLevel, &t.TilesCol, &t.TilesRow, &t.TilesType, &data); err != nil {
+			return report, err
+		}
+		report.Checked++
+		seen[tileKey(t)] = true
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			report.Corrupt = append(report.Corrupt, t)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	tiles, _ := dl.tasksTiles(tasks)
+	for _, t := range tiles {
+		if !seen[tileKey(t)] {
+			report.Missing = append(report.Missing, t)
+		}
+	}
+	return report, nil
+}
+
+func tileKey(t Tile) string {
+	return t.TilesLevel + "/" + t.TilesRow + "/" + t.TilesCol + "/" + strconv.Itoa(t.TilesType)
+}
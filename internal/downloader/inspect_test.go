@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func fileMD5(t *testing.T, path string) [md5.Size]byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md5.Sum(data)
+}
+
+// TestReadersKeepSchema opens a database with the schema of the first
+// release and checks that reading it leaves the file as it was.
+func TestReadersKeepSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	for _, q := range []string{
+		"CREATE TABLE map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id INTEGER PRIMARY KEY AUTOINCREMENT, tile_type INT, tile_data BLOB)",
+		"CREATE TABLE task (id STRING UNIQUE, type INT, count INT, version DOUBLE, language STRING, date DATE, maxLevel INT, minLevel INT)",
+		"INSERT INTO task VALUES (1, 0, 1, 1.0, 'zh', '2021-07-29 10:00:00', 3, 3)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO map(zoom_level,tile_column,tile_row,tile_type,tile_data) VALUES (3,3,6,0,?)", buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	before := fileMD5(t, path)
+
+	info := MapInfo{DbPath: path}
+	report, err := NewDownLoader(info, 1, 1, 1).Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tiles != 1 || len(report.Tasks) != 1 || report.Task.MaxZ != 3 {
+		t.Fatalf("inspect %+v", report)
+	}
+	if v, err := NewDownLoader(info, 1, 1, 1).Verify(); err != nil || v.Checked != 1 || len(v.Corrupt) != 0 {
+		t.Fatalf("verify %v, %v", v, err)
+	}
+	if _, err := NewDownLoader(info, 1, 1, 1).Task(); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "std.mbtiles")
+	if n, err := NewDownLoader(info, 1, 1, 1).Export(ExportMBTiles, out, 0); err != nil || n != 1 {
+		t.Fatalf("export %d tiles, %v", n, err)
+	}
+	if fileMD5(t, path) != before {
+		t.Fatal("reading the database changed it")
+	}
+}
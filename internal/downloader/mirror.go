@@ -0,0 +1,67 @@
+package downloader
+
+import (
+	"fmt"
+	"mapdownloader/config"
+	"net/url"
+	"strings"
+)
+
+func (dl *DownLoader) SetMirrors(tileType int, mirrors []string) {
+	if dl.mirror == nil {
+		dl.mirror = make(map[int][]string)
+	}
+	dl.mirror[tileType] = mirrors
+}
+
+func (dl *DownLoader) mergeMirror(mirror map[int][]string) {
+	if dl.mirror == nil {
+		dl.mirror = make(map[int][]string)
+	}
+	for k, v := range mirror {
+		if _, ok := dl.mirror[k]; !ok {
+			dl.mirror[k] = v
+		}
+	}
+}
+
+func (dl *DownLoader) sources(tileType int) []string {
+	sources := make([]string, 0, len(dl.mirror[tileType])+1)
+	if v, ok := dl.provider[tileType]; ok {
+		sources = append(sources, v)
+	}
+	return append(sources, dl.mirror[tileType]...)
+}
+
+func (dl *DownLoader) tileURL(template string, tile Tile) string {
+	u := strings.Replace(template, "{x}", tile.TilesRow, 1)
+	u = strings.Replace(u, "{y}", tile.TilesCol, 1)
+	return strings.Replace(u, "{z}", tile.TilesLevel, 1)
+}
+
+func (dl *DownLoader) fetchTile(tile *Tile, conditional bool) (err error) {
+	for _, template := range dl.sources(tile.TilesType) {
+		u := dl.tileURL(template, *tile)
+		var data []byte
+		if data, err = dl.getTileBinary(u, tile, conditional); err == nil {
+			tile.TilesBinary = data
+			tile.TilesSource = sourceName(u)
+			tile.TilesVer = config.SOURCE_VERSION[tile.TilesType]
+			return nil
+		} else if err == errNotModified {
+			return err
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no provider for tile type %d", tile.TilesType)
+	}
+	return err
+}
+
+func sourceName(u string) string {
+	if parsed, err := url.Parse(u); err == nil {
+		return parsed.Host
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	OrderScan    = "scan"
+	OrderZoom    = "zoom"
+	OrderSpiral  = "spiral"
+	OrderHilbert = "hilbert"
+)
+
+type orderKey struct {
+	z, x, y, t int
+	ring       int
+	rank       float64
+}
+
+func (dl *DownLoader) orderTiles(jobs []Tile) error {
+	switch dl.mapInfo.Order {
+	case "", OrderScan:
+		return nil
+	case OrderZoom, OrderSpiral, OrderHilbert:
+	default:
+		return fmt.Errorf("unknown order %q", dl.mapInfo.Order)
+	}
+
+	keys := make([]orderKey, len(jobs))
+	centers := make(map[int][2]int)
+	for i := range jobs {
+		t := &jobs[i]
+		k := orderKey{t: t.TilesType}
+		k.z, _ = strconv.Atoi(t.TilesLevel)
+		k.x, _ = strconv.Atoi(t.TilesRow)
+		k.y, _ = strconv.Atoi(t.TilesCol)
+		switch dl.mapInfo.Order {
+		case OrderSpiral:
+			c, ok := centers[k.z]
+			if !ok {
+				c[0], c[1] = dl.centerTile(k.z)
+				centers[k.z] = c
+			}
+			dx, dy := k.x-c[0], k.y-c[1]
+			k.ring = maxInt(absInt(dx), absInt(dy))
+			k.rank = math.Atan2(float64(dy), float64(dx))
+		case OrderHilbert:
+			k.rank = float64(hilbert(k.z, k.x, k.y))
+		}
+		keys[i] = k
+	}
+
+	idx := make([]int, len(jobs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := keys[idx[i]], keys[idx[j]]
+		if a.z != b.z {
+			return a.z < b.z
+		}
+		if a.ring != b.ring {
+			return a.ring < b.ring
+		}
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		return a.t < b.t
+	})
+	sorted := make([]Tile, len(jobs))
+	for i, j := range idx {
+		sorted[i] = jobs[j]
+	}
+	copy(jobs, sorted)
+	return nil
+}
+
+func (dl *DownLoader) centerTile(z int) (int, int) {
+	lng, lat := dl.mapInfo.CenterLng, dl.mapInfo.CenterLat
+	if lng == "" || lat == "" {
+		minLng, _ := strconv.ParseFloat(dl.mapInfo.MinLng, 64)
+		maxLng, _ := strconv.ParseFloat(dl.mapInfo.MaxLng, 64)
+		minLat, _ := strconv.ParseFloat(dl.mapInfo.MinLat, 64)
+		maxLat, _ := strconv.ParseFloat(dl.mapInfo.MaxLat, 64)
+		lng = strconv.FormatFloat((minLng+maxLng)/2, 'f', -1, 64)
+		lat = strconv.FormatFloat((minLat+maxLat)/2, 'f', -1, 64)
+	}
+	return dl.getTilesCoordinate(lng, lat, z)
+}
+
+func hilbert(z, x, y int) int64 {
+	n := int64(1) << uint(z)
+	var d int64
+	hx, hy := int64(x), int64(y)
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry int64
+		if hx&s > 0 {
+			rx = 1
+		}
+		if hy&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				hx = n - 1 - hx
+				hy = n - 1 - hy
+			}
+			hx, hy = hy, hx
+		}
+	}
+	return d
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
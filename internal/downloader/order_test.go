@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestOrderCoversEveryTileOnce(t *testing.T) {
+	world := MapInfo{Type: 0, MinZ: 3, MaxZ: 4, MinLng: "-180", MaxLng: "179.99", MinLat: "85", MaxLat: "-85"}
+	region := testInfo(t)
+	region.Type = 1
+	offCenter := testInfo(t)
+	offCenter.CenterLng, offCenter.CenterLat = "100", "20"
+	for name, info := range map[string]MapInfo{"world": world, "region with two layers": region, "center outside": offCenter} {
+		info.DbPath = ""
+		scan := NewDownLoader(info, 1, 1, 1)
+		scan.GetTaskInfo()
+		want := make(map[string]bool)
+		for _, tile := range scan.jobs {
+			want[tileKey(tile)] = true
+		}
+		if len(want) == 0 || len(want) != len(scan.jobs) {
+			t.Fatalf("%s: scan gave %d tiles, %d distinct", name, len(scan.jobs), len(want))
+		}
+
+		for _, order := range []string{OrderZoom, OrderSpiral, OrderHilbert} {
+			info.Order = order
+			dl := NewDownLoader(info, 1, 1, 1)
+			if n := dl.GetTaskInfo(); n != len(want) {
+				t.Errorf("%s, %s: %d tiles, want %d", name, order, n, len(want))
+			}
+			seen := make(map[string]bool)
+			last := 0
+			for _, tile := range dl.jobs {
+				k := tileKey(tile)
+				if !want[k] || seen[k] {
+					t.Fatalf("%s, %s: tile %v is extra or repeated", name, order, k)
+				}
+				seen[k] = true
+				z, _ := strconv.Atoi(tile.TilesLevel)
+				if z < last {
+					t.Fatalf("%s, %s: zoom %d after %d", name, order, z, last)
+				}
+				last = z
+			}
+		}
+	}
+}
+
+func TestOrderSpiralRings(t *testing.T) {
+	info := MapInfo{Type: 0, MinZ: 4, MaxZ: 4, MinLng: "-180", MaxLng: "179.99", MinLat: "85", MaxLat: "-85",
+		CenterLng: "116.4", CenterLat: "39.9", Order: OrderSpiral}
+	dl := NewDownLoader(info, 1, 1, 1)
+	dl.GetTaskInfo()
+	cx, cy := dl.centerTile(4)
+	last := 0
+	for i, tile := range dl.jobs {
+		x, _ := strconv.Atoi(tile.TilesRow)
+		y, _ := strconv.Atoi(tile.TilesCol)
+		ring := maxInt(absInt(x-cx), absInt(y-cy))
+		if i == 0 && ring != 0 {
+			t.Fatalf("first tile %d,%d, want the center %d,%d", x, y, cx, cy)
+		}
+		if ring < last {
+			t.Fatalf("tile %d,%d in ring %d after ring %d", x, y, ring, last)
+		}
+		last = ring
+	}
+}
+
+// A Hilbert curve over the whole grid moves to a neighbouring tile at every
+// step.
+func TestOrderHilbertSteps(t *testing.T) {
+	info := MapInfo{Type: 0, MinZ: 3, MaxZ: 3, MinLng: "-180", MaxLng: "179.99", MinLat: "85", MaxLat: "-85", Order: OrderHilbert}
+	dl := NewDownLoader(info, 1, 1, 1)
+	if n := dl.GetTaskInfo(); n != 64 {
+		t.Fatalf("%d tiles at zoom 3, want 64", n)
+	}
+	for i := 1; i < len(dl.jobs); i++ {
+		x0, _ := strconv.Atoi(dl.jobs[i-1].TilesRow)
+		y0, _ := strconv.Atoi(dl.jobs[i-1].TilesCol)
+		x1, _ := strconv.Atoi(dl.jobs[i].TilesRow)
+		y1, _ := strconv.Atoi(dl.jobs[i].TilesCol)
+		if absInt(x1-x0)+absInt(y1-y0) != 1 {
+			t.Fatalf("step %d jumps from %d,%d to %d,%d", i, x0, y0, x1, y1)
+		}
+	}
+}
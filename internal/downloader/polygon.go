@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type point struct {
+	x, y float64
+}
+
+// ParsePolygon reads a region outline given as "lng,lat;lng,lat;..." with
+// at least three corners; the last corner connects back to the first.
+func ParsePolygon(spec string) ([][2]float64, error) {
+	corners := make([][2]float64, 0)
+	for _, corner := range strings.Split(spec, ";") {
+		corner = strings.TrimSpace(corner)
+		if corner == "" {
+			continue
+		}
+		parts := strings.Split(corner, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("corner %q is not lng,lat", corner)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("corner %q is not lng,lat", corner)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("corner %q is not lng,lat", corner)
+		}
+		if lng < -180 || lng > 180 || lat < -mercatorLat || lat > mercatorLat {
+			return nil, fmt.Errorf("corner %q is outside the web mercator bounds", corner)
+		}
+		corners = append(corners, [2]float64{lng, lat})
+	}
+	if len(corners) < 3 {
+		return nil, fmt.Errorf("needs at least 3 corners, got %d", len(corners))
+	}
+	return corners, nil
+}
+
+// polygonFilter reports whether tile x, y at zoom z touches the polygon of
+// the task; it is nil when the task has a bbox only.
+func (dl *DownLoader) polygonFilter(z int) func(x, y int) bool {
+	if dl.mapInfo.Polygon == "" {
+		return nil
+	}
+	corners, err := ParsePolygon(dl.mapInfo.Polygon)
+	if err != nil {
+		dl.logln("polygon err", err)
+		return nil
+	}
+	// project once per zoom so a tile is the unit square at x, y
+	n := math.Exp2(float64(z))
+	poly := make([]point, len(corners))
+	for i, c := range corners {
+		lat := c[1] * math.Pi / 180
+		poly[i] = point{
+			x: (c[0] + 180) / 360 * n,
+			y: (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n,
+		}
+	}
+	return func(x, y int) bool {
+		return squareTouches(poly, float64(x), float64(y))
+	}
+}
+
+// squareTouches reports whether the unit square at x, y and poly overlap:
+// a corner of one lies inside the other or their edges cross.
+func squareTouches(poly []point, x, y float64) bool {
+	square := []point{{x, y}, {x + 1, y}, {x + 1, y + 1}, {x, y + 1}}
+	for _, p := range poly {
+		if p.x >= x && p.x <= x+1 && p.y >= y && p.y <= y+1 {
+			return true
+		}
+	}
+	if contains(poly, square[0]) {
+		return true
+	}
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		for j := range square {
+			if crosses(a, b, square[j], square[(j+1)%4]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains is the even-odd test of p against poly.
+func contains(poly []point, p point) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			in = !in
+		}
+	}
+	return in
+}
+
+// crosses reports whether segments ab and cd share a point.
+func crosses(a, b, c, d point) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	if (d1 > 0) != (d2 > 0) && d1 != 0 && d2 != 0 && (d3 > 0) != (d4 > 0) && d3 != 0 && d4 != 0 {
+		return true
+	}
+	return d1 == 0 && between(c, d, a) || d2 == 0 && between(c, d, b) ||
+		d3 == 0 && between(a, b, c) || d4 == 0 && between(a, b, d)
+}
+
+func cross(o, a, b point) float64 {
+	return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+}
+
+// between reports whether p, on the line through a and b, lies on the
+// segment.
+func between(a, b, p point) bool {
+	return math.Min(a.x, b.x) <= p.x && p.x <= math.Max(a.x, b.x) &&
+		math.Min(a.y, b.y) <= p.y && p.y <= math.Max(a.y, b.y)
+}
@@ -0,0 +1,128 @@
+package downloader
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParsePolygon(t *testing.T) {
+	for _, c := range []struct {
+		spec    string
+		corners int
+		err     bool
+	}{
+		{spec: "116.3,39.9;116.5,39.9;116.4,39.97", corners: 3},
+		{spec: " 116.3, 39.9 ; 116.5,39.9;116.5,39.97;116.3,39.97; ", corners: 4},
+		{spec: "116.3,39.9;116.5,39.9", err: true},
+		{spec: "116.3 39.9;116.5 39.9;116.4 39.97", err: true},
+		{spec: "116.3,39.9;116.5,x;116.4,39.97", err: true},
+		{spec: "116.3,39.9;116.5,89;116.4,39.97", err: true},
+		{spec: "", err: true},
+	} {
+		corners, err := ParsePolygon(c.spec)
+		if c.err != (err != nil) || len(corners) != c.corners {
+			t.Errorf("%q: %d corners, err %v", c.spec, len(corners), err)
+		}
+	}
+
+	info := testInfo(t)
+	info.Polygon = "116.3,39.9;116.5"
+	if err := info.Validate(); err == nil {
+		t.Fatal("invalid polygon passed Validate")
+	} else if fe, ok := err.(*FieldError); !ok || fe.Field != "polygon" {
+		t.Fatalf("err %v, want a polygon field error", err)
+	}
+}
+
+func polygonTiles(t *testing.T, info MapInfo) map[string]bool {
+	dl := NewDownLoader(info, 1, 1, 1)
+	dl.GetTaskInfo()
+	tiles := make(map[string]bool)
+	for _, tile := range dl.jobs {
+		tiles[tileKey(tile)] = true
+	}
+	return tiles
+}
+
+func TestPolygonTiles(t *testing.T) {
+	info := MapInfo{Type: 0, MinZ: 8, MaxZ: 10, MinLng: "100.3", MaxLng: "119.7", MinLat: "39.7", MaxLat: "20.3"}
+	bbox := polygonTiles(t, info)
+
+	// the outline of the bbox itself keeps every tile
+	info.Polygon = "100.3,39.7;119.7,39.7;119.7,20.3;100.3,20.3"
+	if got := polygonTiles(t, info); len(got) != len(bbox) {
+		t.Fatalf("rectangle polygon gave %d tiles, the bbox %d", len(got), len(bbox))
+	}
+
+	// the north-west half of the bbox
+	info.Polygon = "100.3,39.7;119.7,39.7;100.3,20.3"
+	half := polygonTiles(t, info)
+	if len(half) >= len(bbox) || len(half) < len(bbox)/2 {
+		t.Fatalf("triangle gave %d tiles of %d", len(half), len(bbox))
+	}
+	dl := NewDownLoader(info, 1, 1, 1)
+	for z := 8; z <= 10; z++ {
+		for _, corner := range [][2]string{{"100.3", "39.7"}, {"119.7", "39.7"}, {"100.3", "20.3"}, {"105", "30"}} {
+			x, y := dl.getTilesCoordinate(corner[0], corner[1], z)
+			if key := tileKey(Tile{TilesLevel: strconv.Itoa(z), TilesRow: strconv.Itoa(x), TilesCol: strconv.Itoa(y)}); !half[key] {
+				t.Errorf("zoom %d: tile %d,%d at %v dropped", z, x, y, corner)
+			}
+		}
+		// the south-east corner is well outside
+		x, y := dl.getTilesCoordinate("119.7", "20.3", z)
+		if key := tileKey(Tile{TilesLevel: strconv.Itoa(z), TilesRow: strconv.Itoa(x), TilesCol: strconv.Itoa(y)}); half[key] {
+			t.Errorf("zoom %d: tile %d,%d outside the triangle kept", z, x, y)
+		}
+	}
+	for key := range half {
+		if !bbox[key] {
+			t.Fatalf("tile %s outside the bbox", key)
+		}
+	}
+}
+
+func TestAppendPolygon(t *testing.T) {
+	tileServer(t, nil)
+	info := testInfo(t)
+	info.MinZ, info.MaxZ = 12, 14
+	dl := NewDownLoader(info, 16, 16, 8)
+	full := dl.GetTaskInfo()
+	info.Polygon = "116.30,39.97;116.50,39.97;116.30,39.90"
+	dl = NewDownLoader(info, 16, 16, 8)
+	n := dl.GetTaskInfo()
+	if n == 0 || n >= full {
+		t.Fatalf("polygon gave %d tiles, the bbox %d", n, full)
+	}
+	if !dl.Start() {
+		t.Fatal("download did not start")
+	}
+
+	// a second region appended next to it
+	second := info
+	second.Polygon = "116.50,39.97;116.50,39.90;116.30,39.90"
+	second.Append = true
+	dl = NewDownLoader(second, 16, 16, 8)
+	dl.GetTaskInfo()
+	if !dl.Start() {
+		t.Fatal("append did not start")
+	}
+
+	dl = NewDownLoader(MapInfo{DbPath: info.DbPath}, 1, 1, 1)
+	report, err := dl.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tasks) != 2 || report.Tasks[0].Polygon != info.Polygon || report.Tasks[1].Polygon != second.Polygon {
+		t.Fatalf("tasks %+v, want one row per polygon", report.Tasks)
+	}
+	if report.Task.Polygon != "" {
+		t.Fatalf("combined task kept polygon %q", report.Task.Polygon)
+	}
+	verify, err := NewDownLoader(MapInfo{DbPath: info.DbPath}, 1, 1, 1).Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verify.Missing) != 0 || verify.Checked != report.Tiles {
+		t.Fatalf("verify %v after downloading both polygons", verify)
+	}
+}
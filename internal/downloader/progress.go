@@ -0,0 +1,170 @@
+package downloader
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type ZoomProgress struct {
+	Zoom   int
+	Total  int64
+	Done   int64
+	Failed int64
+}
+
+type Progress struct {
+	Total       int64
+	Done        int64
+	Failed      int64
+	Skipped     int64
+	Bytes       int64
+	Percent     float64
+	TilesPerSec float64
+	BytesPerSec float64
+	Elapsed     time.Duration
+	ETA         time.Duration
+	Zooms       []ZoomProgress
+}
+
+type zoomCounter struct {
+	total    int64
+	done     int64
+	failed   int64
+	finished int64
+}
+
+type counters struct {
+	total   int64
+	done    int64
+	failed  int64
+	skipped int64
+	bytes   int64
+	start   int64
+	end     int64
+	zooms   map[int]*zoomCounter
+}
+
+func newCounters(tiles []Tile) *counters {
+	c := &counters{
+		total: int64(len(tiles)),
+		zooms: make(map[int]*zoomCounter),
+	}
+	for _, t := range tiles {
+		z, _ := strconv.Atoi(t.TilesLevel)
+		zc, ok := c.zooms[z]
+		if !ok {
+			zc = &zoomCounter{}
+			c.zooms[z] = zc
+		}
+		zc.total++
+	}
+	return c
+}
+
+func (c *counters) begin() {
+	atomic.StoreInt64(&c.start, time.Now().UnixNano())
+	atomic.StoreInt64(&c.end, 0)
+}
+
+func (c *counters) finish() {
+	atomic.StoreInt64(&c.end, time.Now().UnixNano())
+}
+
+func (c *counters) addDone(tile Tile) bool {
+	atomic.AddInt64(&c.done, 1)
+	atomic.AddInt64(&c.bytes, int64(len(tile.TilesBinary)))
+	if zc := c.zoom(tile); zc != nil {
+		atomic.AddInt64(&zc.done, 1)
+		return atomic.AddInt64(&zc.finished, 1) == zc.total
+	}
+	return false
+}
+
+func (c *counters) addFailed(tile Tile) bool {
+	atomic.AddInt64(&c.failed, 1)
+	if zc := c.zoom(tile); zc != nil {
+		atomic.AddInt64(&zc.failed, 1)
+		return atomic.AddInt64(&zc.finished, 1) == zc.total
+	}
+	return false
+}
+
+func (c *counters) addSkipped(tile Tile) bool {
+	atomic.AddInt64(&c.skipped, 1)
+	if zc := c.zoom(tile); zc != nil {
+		atomic.AddInt64(&zc.done, 1)
+		return atomic.AddInt64(&zc.finished, 1) == zc.total
+	}
+	return false
+}
+
+func (c *counters) zoom(tile Tile) *zoomCounter {
+	z, ok := zoomOf(tile)
+	if !ok {
+		return nil
+	}
+	return c.zooms[z]
+}
+
+func zoomOf(tile Tile) (int, bool) {
+	z, err := strconv.Atoi(tile.TilesLevel)
+	return z, err == nil
+}
+
+func (c *counters) finished() int64 {
+	return atomic.LoadInt64(&c.done) + atomic.LoadInt64(&c.failed) + atomic.LoadInt64(&c.skipped)
+}
+
+func (c *counters) snapshot() Progress {
+	p := Progress{
+		Total:   c.total,
+		Done:    atomic.LoadInt64(&c.done),
+		Failed:  atomic.LoadInt64(&c.failed),
+		Skipped: atomic.LoadInt64(&c.skipped),
+		Bytes:   atomic.LoadInt64(&c.bytes),
+		Zooms:   make([]ZoomProgress, 0, len(c.zooms)),
+	}
+	finished := p.Done + p.Failed + p.Skipped
+	if p.Total != 0 {
+		p.Percent = float64(finished) / float64(p.Total)
+	}
+	if start := atomic.LoadInt64(&c.start); start != 0 {
+		end := atomic.LoadInt64(&c.end)
+		if end == 0 {
+			end = time.Now().UnixNano()
+		}
+		p.Elapsed = time.Duration(end - start)
+	}
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.TilesPerSec = float64(finished) / secs
+		p.BytesPerSec = float64(p.Bytes) / secs
+	}
+	if p.TilesPerSec > 0 {
+		p.ETA = time.Duration(float64(p.Total-finished) / p.TilesPerSec * float64(time.Second))
+	}
+	for z, zc := range c.zooms {
+		p.Zooms = append(p.Zooms, ZoomProgress{
+			Zoom:   z,
+			Total:  zc.total,
+			Done:   atomic.LoadInt64(&zc.done),
+			Failed: atomic.LoadInt64(&zc.failed),
+		})
+	}
+	sort.Slice(p.Zooms, func(i, j int) bool {
+		return p.Zooms[i].Zoom < p.Zooms[j].Zoom
+	})
+	return p
+}
+
+func (dl *DownLoader) counters() *counters {
+	if c, ok := dl.progress.Load().(*counters); ok {
+		return c
+	}
+	return newCounters(nil)
+}
+
+func (dl *DownLoader) Progress() Progress {
+	return dl.counters().snapshot()
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// watch polls Progress while Start runs and checks that the counts only grow.
+func watch(t *testing.T, dl *DownLoader) Progress {
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		var last Progress
+		n := 0
+		for {
+			select {
+			case <-done:
+				polled <- n
+				return
+			default:
+			}
+			p := dl.Progress()
+			if p.Done < last.Done || p.Failed < last.Failed || p.Skipped < last.Skipped || p.Percent > 1 {
+				t.Errorf("progress went from %+v to %+v", last, p)
+			}
+			last = p
+			n++
+		}
+	}()
+	if !dl.Start() {
+		t.Fatal("download did not start")
+	}
+	close(done)
+	if <-polled == 0 {
+		t.Fatal("progress was never polled")
+	}
+	return dl.Progress()
+}
+
+func TestProgressWhileDownloading(t *testing.T) {
+	tileServer(t, func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/0/12/")
+	})
+	info := testInfo(t)
+	dl := NewDownLoader(info, 16, 16, 8)
+	dl.GetTaskInfo()
+	p := watch(t, dl)
+	if p.Total != 14 || p.Done != 8 || p.Failed != 6 || p.Skipped != 0 {
+		t.Fatalf("total %d done %d failed %d skipped %d, want 14 8 6 0", p.Total, p.Done, p.Failed, p.Skipped)
+	}
+	if p.Percent != 1 {
+		t.Fatalf("percent %v, want 1", p.Percent)
+	}
+	want := []ZoomProgress{{10, 4, 4, 0}, {11, 4, 4, 0}, {12, 6, 0, 6}}
+	if !reflect.DeepEqual(p.Zooms, want) {
+		t.Fatalf("zooms %+v, want %+v", p.Zooms, want)
+	}
+
+	// appending skips the stored tiles and retries the failed ones
+	info.Append = true
+	dl = NewDownLoader(info, 16, 16, 8)
+	dl.GetTaskInfo()
+	p = watch(t, dl)
+	if p.Total != 14 || p.Done != 0 || p.Failed != 6 || p.Skipped != 8 {
+		t.Fatalf("total %d done %d failed %d skipped %d, want 14 0 6 8", p.Total, p.Done, p.Failed, p.Skipped)
+	}
+	if p.Percent != 1 {
+		t.Fatalf("percent %v, want 1", p.Percent)
+	}
+}
@@ -0,0 +1,230 @@
+package downloader
+
+import (
+	"fmt"
+	"mapdownloader/config"
+	"strings"
+	"time"
+)
+
+type Filter struct {
+	OlderThan   time.Duration
+	Zooms       []int
+	Region      bool
+	Conditional bool
+}
+
+type UpdateReport struct {
+	Unchanged int
+	Updated   int
+	Gone      int
+	Failed    int
+}
+
+func (r UpdateReport) String() string {
+	return fmt.Sprintf("unchanged: %d  updated: %d  gone: %d  failed: %d", r.Unchanged, r.Updated, r.Gone, r.Failed)
+}
+
+func (dl *DownLoader) Update() (UpdateReport, error) {
+	return dl.Refresh(Filter{Conditional: true})
+}
+
+func (dl *DownLoader) Refresh(filter Filter) (UpdateReport, error) {
+	report := UpdateReport{}
+	if !dl.exists(dl.mapInfo.DbPath) {
+		return report, fmt.Errorf("database %s not found", dl.mapInfo.DbPath)
+	}
+	dl.initDB()
+	defer dl.db.Close()
+	if dl.mapInfo.Language == "" {
+		dl.db.QueryRow("SELECT language FROM task LIMIT 1").Scan(&dl.mapInfo.Language)
+	}
+	dl.prepare()
+
+	tiles, err := dl.storedTiles(filter)
+	if err != nil {
+		return report, err
+	}
+	dl.progress.Store(newCounters(tiles))
+	dl.counters().begin()
+	tilesPipe := make(chan Tile, dl.capPipe)
+	errPipe := make(chan error, dl.capPipe)
+	flush := make(chan struct{})
+	done := make(chan error)
+	stop := make(chan struct{})
+	watchers := dl.watch(stop, flush)
+	go func() {
+		done <- dl.replaceTiles(tilesPipe, errPipe, flush, &report)
+	}()
+
+	pool := dl.runPool(func(err error) {
+		errPipe <- err
+	})
+	for _, v := range tiles {
+		tile := v
+		pool.SubmitErr(func() error {
+			if err := dl.fetchTile(&tile, filter.Conditional); err != nil {
+				return &TileError{tile, err}
+			}
+			tilesPipe <- tile
+			return nil
+		})
+	}
+	pool.Wait()
+	pool.Stop()
+	close(stop)
+	watchers.Wait()
+	close(tilesPipe)
+	close(errPipe)
+	err = <-done
+	dl.counters().finish()
+	dl.emitFinished()
+	return report, err
+}
+
+func (dl *DownLoader) storedTiles(filter Filter) ([]Tile, error) {
+	where, args := dl.filterClause(filter)
+	rows, err := dl.db.Query("SELECT tile_id,zoom_level,tile_column,tile_row,tile_type,IFNULL(tile_etag,''),IFNULL(tile_modified,'') FROM map"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiles := make([]Tile, 0)
+	for rows.Next() {
+		t := Tile{}
+		if err := rows.Scan(&t.TilesID, &t.TilesLevel, &t.TilesCol, &t.TilesRow, &t.TilesType, &t.TilesETag, &t.TilesMod); err != nil {
+			return nil, err
+		}
+		tiles = append(tiles, t)
+	}
+	return tiles, rows.Err()
+}
+
+func (dl *DownLoader) replaceTiles(pipe chan Tile, errs chan error, flush chan struct{}, report *UpdateReport) error {
+	progress := dl.counters()
+	writer := newBatch(dl.db, config.SAVE_BATCH,
+		"SELECT tile_data IS ? FROM map WHERE tile_id = ?",
+		"UPDATE map SET tile_data=?,tile_source=?,tile_etag=?,tile_modified=?,fetched_at=?,source_version=? WHERE tile_id=?")
+	for pipe != nil || errs != nil {
+		select {
+		case ti, ok := <-pipe:
+			if !ok {
+				pipe = nil
+				continue
+			}
+			same, err := writer.stmt(0)
+			if err != nil {
+				dl.logln("update tile err", err)
+				report.Failed++
+				dl.emitTile(TileFailed, ti, err, progress.addFailed(ti))
+				continue
+			}
+			var equal bool
+			if err := same.QueryRow(ti.TilesBinary, ti.TilesID).Scan(&equal); err != nil {
+				dl.logln("update tile err", err)
+				report.Failed++
+				dl.emitTile(TileFailed, ti, err, progress.addFailed(ti))
+				continue
+			}
+			if equal {
+				report.Unchanged++
+				if progress.addSkipped(ti) {
+					dl.emitZoom(ti)
+				}
+				continue
+			}
+			update, _ := writer.stmt(1)
+			if _, err := update.Exec(ti.TilesBinary, ti.TilesSource, ti.TilesETag, ti.TilesMod, time.Now().Unix(), ti.TilesVer, ti.TilesID); err != nil {
+				dl.logln("update tile err", err)
+				report.Failed++
+				dl.emitTile(TileFailed, ti, err, progress.addFailed(ti))
+			} else {
+				report.Updated++
+				dl.emitTile(TileDone, ti, nil, progress.addDone(ti))
+			}
+			if err := writer.add(); err != nil {
+				dl.logln("update tile err", err)
+			}
+		case <-flush:
+			if err := writer.commit(); err != nil {
+				dl.logln("update tile err", err)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			tile := Tile{}
+			if e, ok := err.(*TileError); ok {
+				tile, err = e.Tile, e.Err
+			}
+			if err == errNotModified {
+				report.Unchanged++
+				if progress.addSkipped(tile) {
+					dl.emitZoom(tile)
+				}
+			} else if e, ok := err.(*StatusError); ok && (e.Code == 404 || e.Code == 410) {
+				report.Gone++
+				dl.emitTile(TileFailed, tile, err, progress.addFailed(tile))
+			} else {
+				dl.logln("update tile err", err)
+				report.Failed++
+				dl.emitTile(TileFailed, tile, err, progress.addFailed(tile))
+			}
+		}
+	}
+	return writer.commit()
+}
+
+func (dl *DownLoader) filterClause(filter Filter) (string, []interface{}) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+	if filter.OlderThan > 0 {
+		conds = append(conds, "(fetched_at IS NULL OR fetched_at < ?)")
+		args = append(args, time.Now().Add(-filter.OlderThan).Unix())
+	}
+	zooms := filter.Zooms
+	if len(zooms) != 0 {
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(zooms)), ",")
+		conds = append(conds, "zoom_level IN ("+marks+")")
+		for _, z := range zooms {
+			args = append(args, z)
+		}
+	}
+	if filter.Region {
+		if len(zooms) == 0 {
+			for z := dl.mapInfo.MinZ; z <= dl.mapInfo.MaxZ; z++ {
+				zooms = append(zooms, z)
+			}
+		}
+		region := make([]string, 0, len(zooms))
+		for _, z := range zooms {
+			x1, y1 := dl.getTilesCoordinate(dl.mapInfo.MinLng, dl.mapInfo.MinLat, z)
+			x2, y2 := dl.getTilesCoordinate(dl.mapInfo.MaxLng, dl.mapInfo.MaxLat, z)
+			region = append(region, "(zoom_level = ? AND tile_row BETWEEN ? AND ? AND tile_column BETWEEN ? AND ?)")
+			args = append(args, z, minInt(x1, x2), maxInt(x1, x2), minInt(y1, y2), maxInt(y1, y2))
+		}
+		if len(region) == 0 {
+			region = append(region, "0")
+		}
+		conds = append(conds, "("+strings.Join(region, " OR ")+")")
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,44 @@
+package downloader
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestRefreshWritesChangedTiles(t *testing.T) {
+	tileServer(t, nil)
+	info := testInfo(t)
+	dl := NewDownLoader(info, 4, 16, 16)
+	dl.GetTaskInfo()
+	if !dl.Start() {
+		t.Fatal("download did not start")
+	}
+
+	db, err := sql.Open("sqlite3", info.DbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// two tiles changed on the server since, the rest are marked so a write
+	// shows up
+	if _, err := db.Exec("UPDATE map SET fetched_at = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE map SET tile_data = x'00' WHERE tile_id IN (SELECT tile_id FROM map LIMIT 2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewDownLoader(info, 4, 16, 16).Refresh(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 2 || report.Unchanged != 12 || report.Failed != 0 {
+		t.Fatalf("report %v, want 2 updated and 12 unchanged", report)
+	}
+	var written, stale int
+	db.QueryRow("SELECT COUNT(*) FROM map WHERE fetched_at != 1").Scan(&written)
+	db.QueryRow("SELECT COUNT(*) FROM map WHERE tile_data = x'00'").Scan(&stale)
+	if written != 2 || stale != 0 {
+		t.Fatalf("%d rows written, %d left stale; want only the 2 changed tiles written", written, stale)
+	}
+}
@@ -0,0 +1,329 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/s3"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Summary describes a finished job. A move hook changes DbPath for the hooks
+// after it.
+type Summary struct {
+	DbPath   string
+	Info     downloader.MapInfo
+	Progress downloader.Progress
+}
+
+type Result struct {
+	Hook    config.Hook
+	Output  string
+	Err     error
+	Elapsed time.Duration
+}
+
+func (r Result) String() string {
+	if r.Err != nil {
+		return r.Hook.Type + ": " + r.Err.Error()
+	}
+	return r.Hook.Type + ": " + r.Output
+}
+
+// Run runs hooks in order. A failed hook does not stop the ones after it.
+func Run(hooks []config.Hook, s *Summary) []Result {
+	results := make([]Result, 0, len(hooks))
+	for _, h := range hooks {
+		start := time.Now()
+		out, err := run(h, s)
+		results = append(results, Result{Hook: h, Output: out, Err: err, Elapsed: time.Since(start)})
+	}
+	return results
+}
+
+func run(h config.Hook, s *Summary) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout := timeout(h); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	switch h.Type {
+	case "shell":
+		return shell(ctx, h, s)
+	case "s3":
+		return upload(ctx, h, s)
+	case "webhook":
+		return webhook(ctx, h, s)
+	case "move":
+		return move(ctx, h, s)
+	}
+	return "", fmt.Errorf("unknown hook type %q", h.Type)
+}
+
+func timeout(h config.Hook) time.Duration {
+	if h.Timeout != 0 {
+		return time.Duration(h.Timeout) * time.Second
+	}
+	if h.Type == "shell" || h.Type == "webhook" {
+		return time.Duration(config.HOOK_TIMEOUT) * time.Second
+	}
+	return 0
+}
+
+// Expand resolves secrets and the job placeholders in str.
+func (s *Summary) Expand(str string) (string, error) {
+	str, missing := downloader.ExpandSecrets(str)
+	if len(missing) != 0 {
+		return "", fmt.Errorf("missing secrets %s", strings.Join(missing, ","))
+	}
+	return s.placeholders(str, nil), nil
+}
+
+// placeholders replaces the job placeholders in str, passing each value
+// through quote when it is set.
+func (s *Summary) placeholders(str string, quote func(string) string) string {
+	file := filepath.Base(s.DbPath)
+	layer := ""
+	for name, t := range config.LAYERS {
+		if t == s.Info.Type {
+			layer = name
+		}
+	}
+	pairs := []string{
+		"{db}", s.DbPath,
+		"{file}", file,
+		"{name}", strings.TrimSuffix(file, filepath.Ext(file)),
+		"{date}", time.Now().Format("20060102"),
+		"{layer}", layer,
+		"{minZ}", strconv.Itoa(s.Info.MinZ),
+		"{maxZ}", strconv.Itoa(s.Info.MaxZ),
+	}
+	if quote != nil {
+		for i := 1; i < len(pairs); i += 2 {
+			pairs[i] = quote(pairs[i])
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(str)
+}
+
+// shellQuote makes v a single word for sh -c, or for cmd /C on windows where
+// file names cannot hold a double quote.
+func shellQuote(v string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + v + `"`
+	}
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+// shell leaves $VARS to the shell, which also sees MAP_DB, MAP_TILES,
+// MAP_DONE, MAP_FAILED and MAP_BYTES. Placeholders are quoted, so a path
+// with spaces or shell characters stays one argument.
+func shell(ctx context.Context, h config.Hook, s *Summary) (string, error) {
+	command := s.placeholders(h.Command, shellQuote)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(),
+		"MAP_DB="+s.DbPath,
+		"MAP_TILES="+strconv.FormatInt(s.Progress.Total, 10),
+		"MAP_DONE="+strconv.FormatInt(s.Progress.Done, 10),
+		"MAP_FAILED="+strconv.FormatInt(s.Progress.Failed, 10),
+		"MAP_BYTES="+strconv.FormatInt(s.Progress.Bytes, 10),
+	)
+	// a file rather than a pipe: Wait would also wait for children that
+	// inherited the pipe, past the timeout
+	f, err := ioutil.TempFile("", "hook")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	cmd.Stdout, cmd.Stderr = f, f
+	err = cmd.Run()
+	out, _ := ioutil.ReadFile(f.Name())
+	return lastLine(string(out)), err
+}
+
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// S3Client builds the client of an s3 hook and expands its key template,
+// config.S3_KEY when the hook has none.
+func S3Client(h config.Hook, s *Summary) (*s3.Client, string, error) {
+	if h.AccessKey == "" {
+		h.AccessKey = "${AWS_ACCESS_KEY_ID}"
+	}
+	if h.SecretKey == "" {
+		h.SecretKey = "${AWS_SECRET_ACCESS_KEY}"
+	}
+	if h.Key == "" {
+		h.Key = config.S3_KEY
+	}
+	for _, f := range []*string{&h.Endpoint, &h.Region, &h.Bucket, &h.Key, &h.AccessKey, &h.SecretKey} {
+		v, err := s.Expand(*f)
+		if err != nil {
+			return nil, "", err
+		}
+		*f = v
+	}
+	if h.Endpoint == "" || h.Bucket == "" {
+		return nil, "", fmt.Errorf("s3 hook needs endpoint and bucket")
+	}
+	client := s3.NewClient(h.Endpoint, h.Region, h.Bucket, h.AccessKey, h.SecretKey)
+	client.PathStyle = h.PathStyle
+	return client, h.Key, nil
+}
+
+func upload(ctx context.Context, h config.Hook, s *Summary) (string, error) {
+	client, key, err := S3Client(h, s)
+	if err != nil {
+		return "", err
+	}
+	result, err := client.Upload(ctx, key, s.DbPath)
+	if err != nil {
+		return "", err
+	}
+	out := result.URL.String()
+	if result.Parts > 1 {
+		out += fmt.Sprintf(" (%d parts", result.Parts)
+		if result.Resumed != 0 {
+			out += fmt.Sprintf(", %d resumed", result.Resumed)
+		}
+		out += ")"
+	}
+	return out, nil
+}
+
+type webhookBody struct {
+	Event   string             `json:"event"`
+	DbPath  string             `json:"db"`
+	Info    downloader.MapInfo `json:"info"`
+	Total   int64              `json:"total"`
+	Done    int64              `json:"done"`
+	Failed  int64              `json:"failed"`
+	Skipped int64              `json:"skipped"`
+	Bytes   int64              `json:"bytes"`
+	Elapsed float64            `json:"elapsed"`
+}
+
+func webhook(ctx context.Context, h config.Hook, s *Summary) (string, error) {
+	u, err := s.Expand(h.URL)
+	if err != nil {
+		return "", err
+	}
+	p := s.Progress
+	body, err := json.Marshal(webhookBody{
+		Event:   "finished",
+		DbPath:  s.DbPath,
+		Info:    s.Info,
+		Total:   p.Total,
+		Done:    p.Done,
+		Failed:  p.Failed,
+		Skipped: p.Skipped,
+		Bytes:   p.Bytes,
+		Elapsed: p.Elapsed.Seconds(),
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Header {
+		if v, err = s.Expand(v); err != nil {
+			return "", err
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("webhook %s: http status %d", req.URL.Host, resp.StatusCode)
+	}
+	return fmt.Sprintf("%s: http status %d", req.URL.Host, resp.StatusCode), nil
+}
+
+func move(ctx context.Context, h config.Hook, s *Summary) (string, error) {
+	target, err := s.Expand(h.Path)
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		return "", fmt.Errorf("move hook needs a path")
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		target = filepath.Join(target, filepath.Base(s.DbPath))
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if err := rename(s.DbPath, target); err != nil {
+		// rename fails across file systems
+		if err := copyFile(ctx, s.DbPath, target); err != nil {
+			return "", err
+		}
+		if err := os.Remove(s.DbPath); err != nil {
+			return "", err
+		}
+	}
+	s.DbPath = target
+	return target, nil
+}
+
+// rename is os.Rename; tests replace it to take the copy path.
+var rename = os.Rename
+
+func copyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, ctxReader{ctx, in}); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// ctxReader stops a copy once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,164 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func testSummary(t *testing.T, name string) *Summary {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte("tiles"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &Summary{
+		DbPath:   path,
+		Info:     downloader.MapInfo{Type: 0, MinZ: 10, MaxZ: 12, DbPath: path},
+		Progress: downloader.Progress{Total: 14, Done: 8, Failed: 6, Bytes: 1024},
+	}
+}
+
+func TestShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh only")
+	}
+	s := testSummary(t, "it's a $(touch pwned); db.mbtiles")
+	out := filepath.Join(filepath.Dir(s.DbPath), "out")
+	h := config.Hook{Type: "shell", Command: `printf '%s|%s|%s|%s' {db} {name} "$MAP_DONE" "$MAP_FAILED" > ` + out + `; echo {maxZ}`}
+	r := Run([]config.Hook{h}, s)[0]
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if r.Output != "12" {
+		t.Fatalf("output %q, want the last line", r.Output)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := s.DbPath + "|it's a $(touch pwned); db|8|6"
+	if string(data) != want {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Fatal("the database path ran as a command")
+	}
+}
+
+func TestShellTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh only")
+	}
+	s := testSummary(t, "tiles.db")
+	start := time.Now()
+	r := Run([]config.Hook{{Type: "shell", Command: "sleep 10", Timeout: 1}}, s)[0]
+	if r.Err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("err %v after %v, want a timeout after 1s", r.Err, time.Since(start))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	hookTimeout := time.Duration(config.HOOK_TIMEOUT) * time.Second
+	for _, c := range []struct {
+		hook config.Hook
+		want time.Duration
+	}{
+		{config.Hook{Type: "shell"}, hookTimeout},
+		{config.Hook{Type: "webhook"}, hookTimeout},
+		{config.Hook{Type: "s3"}, 0},
+		{config.Hook{Type: "move"}, 0},
+		{config.Hook{Type: "s3", Timeout: 30}, 30 * time.Second},
+	} {
+		if got := timeout(c.hook); got != c.want {
+			t.Errorf("%s hook with timeout %d: %v, want %v", c.hook.Type, c.hook.Timeout, got, c.want)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var body webhookBody
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("HOOK_TEST_TOKEN", "secret")
+	defer os.Unsetenv("HOOK_TEST_TOKEN")
+
+	s := testSummary(t, "tiles.db")
+	hooks := []config.Hook{
+		{Type: "webhook", URL: srv.URL + "/{name}", Header: map[string]string{"Authorization": "Bearer ${HOOK_TEST_TOKEN}"}},
+		{Type: "webhook", URL: srv.URL + "/fail"},
+	}
+	results := Run(hooks, s)
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if body.Event != "finished" || body.DbPath != s.DbPath || body.Done != 8 || body.Failed != 6 {
+		t.Fatalf("body %+v", body)
+	}
+	if results[1].Err == nil {
+		t.Fatal("a 502 counted as success")
+	}
+	if auth != "" {
+		t.Fatalf("second webhook sent %q", auth)
+	}
+}
+
+func TestMove(t *testing.T) {
+	s := testSummary(t, "tiles.db")
+	src := s.DbPath
+	dir := t.TempDir()
+	r := Run([]config.Hook{{Type: "move", Path: filepath.Join(dir, "{layer}-{minZ}-{maxZ}.db")}}, s)[0]
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	want := filepath.Join(dir, "roadmap-10-12.db")
+	if s.DbPath != want || r.Output != want {
+		t.Fatalf("moved to %q, want %q", s.DbPath, want)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("source still there: %v", err)
+	}
+}
+
+func TestMoveAcrossDevices(t *testing.T) {
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid cross-device link")}
+	}
+	defer func() { rename = os.Rename }()
+
+	s := testSummary(t, "tiles.db")
+	src := s.DbPath
+	dir := t.TempDir()
+	r := Run([]config.Hook{{Type: "move", Path: dir}}, s)[0]
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	want := filepath.Join(dir, "tiles.db")
+	if s.DbPath != want {
+		t.Fatalf("moved to %q, want %q", s.DbPath, want)
+	}
+	if data, err := ioutil.ReadFile(want); err != nil || string(data) != "tiles" {
+		t.Fatalf("copy %q, %v", data, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("source still there: %v", err)
+	}
+}
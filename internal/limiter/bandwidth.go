@@ -0,0 +1,90 @@
+package limiter
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type Bandwidth struct {
+	mu       sync.Mutex
+	schedule Schedule
+	tokens   float64
+	last     time.Time
+}
+
+func NewBandwidth(schedule Schedule) *Bandwidth {
+	return &Bandwidth{
+		schedule: schedule,
+		last:     time.Now(),
+	}
+}
+
+func (b *Bandwidth) Rate() int64 {
+	if b == nil {
+		return Unlimited
+	}
+	return b.schedule.Rate(time.Now())
+}
+
+func (b *Bandwidth) Wait() {
+	b.Take(0)
+}
+
+func (b *Bandwidth) Take(n int) {
+	if b == nil {
+		return
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		rate := b.schedule.Rate(now)
+		if rate == Unlimited {
+			b.last = now
+			b.mu.Unlock()
+			return
+		}
+		if rate == Paused {
+			b.tokens = 0
+			b.last = now
+			b.mu.Unlock()
+			time.Sleep(time.Second)
+			continue
+		}
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+		b.last = now
+		b.tokens -= float64(n)
+		var wait time.Duration
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+		}
+		b.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		return
+	}
+}
+
+func (b *Bandwidth) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &bandwidthReader{r, b}
+}
+
+type bandwidthReader struct {
+	r io.Reader
+	b *Bandwidth
+}
+
+func (br *bandwidthReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if n > 0 {
+		br.b.Take(n)
+	}
+	return n, err
+}
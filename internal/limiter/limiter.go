@@ -0,0 +1,141 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+type Bucket struct {
+	mu      sync.Mutex
+	max     float64
+	min     float64
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	blocked time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		max:    rate,
+		min:    rate / 64,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) Wait() {
+	if b == nil || b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if b.blocked.After(now.Add(wait)) {
+		wait = b.blocked.Sub(now)
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (b *Bucket) Backoff(retryAfter time.Duration) {
+	if b == nil || b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate /= 2
+	if b.rate < b.min {
+		b.rate = b.min
+	}
+	if b.tokens > 0 {
+		b.tokens = 0
+	}
+	if retryAfter > 0 {
+		if until := time.Now().Add(retryAfter); until.After(b.blocked) {
+			b.blocked = until
+		}
+	}
+}
+
+func (b *Bucket) Recover() {
+	if b == nil || b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate < b.max {
+		b.rate += b.max / 100
+		if b.rate > b.max {
+			b.rate = b.max
+		}
+	}
+}
+
+func (b *Bucket) Rate() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+func (l *Limiter) Bucket(host string) *Bucket {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[host] = b
+	}
+	return b
+}
+
+func (l *Limiter) Rates() map[string]float64 {
+	rates := make(map[string]float64)
+	if l == nil {
+		return rates
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for host, b := range l.buckets {
+		rates[host] = b.Rate()
+	}
+	return rates
+}
@@ -0,0 +1,78 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func waitN(b *Bucket, n int) time.Duration {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		b.Wait()
+	}
+	return time.Since(start)
+}
+
+func TestBucketRateAndBurst(t *testing.T) {
+	for _, c := range []struct {
+		rate  float64
+		burst int
+		n     int
+		min   time.Duration
+		max   time.Duration
+	}{
+		// the burst goes out at once
+		{rate: 10, burst: 5, n: 5, max: 50 * time.Millisecond},
+		// then one token every 1/rate
+		{rate: 100, burst: 5, n: 25, min: 190 * time.Millisecond, max: 400 * time.Millisecond},
+		// a burst below one still lets a request through
+		{rate: 50, burst: 0, n: 6, min: 90 * time.Millisecond, max: 300 * time.Millisecond},
+		// no rate, no limit
+		{rate: 0, burst: 1, n: 1000, max: 50 * time.Millisecond},
+	} {
+		b := NewBucket(c.rate, c.burst)
+		if d := waitN(b, c.n); d < c.min || d > c.max {
+			t.Errorf("rate %g burst %d: %d requests took %v, want %v..%v", c.rate, c.burst, c.n, d, c.min, c.max)
+		}
+	}
+}
+
+func TestBucketBackoff(t *testing.T) {
+	b := NewBucket(64, 1)
+	for i, want := range []float64{32, 16, 8, 4, 2, 1, 1} {
+		b.Backoff(0)
+		if b.Rate() != want {
+			t.Fatalf("rate %g after %d backoffs, want %g", b.Rate(), i+1, want)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		b.Recover()
+	}
+	if b.Rate() != 64 {
+		t.Fatalf("rate %g after recovering, want 64", b.Rate())
+	}
+
+	b = NewBucket(1000, 10)
+	b.Backoff(200 * time.Millisecond)
+	if d := waitN(b, 1); d < 150*time.Millisecond {
+		t.Fatalf("request after Retry-After 200ms went out in %v", d)
+	}
+}
+
+func TestLimiterPerHost(t *testing.T) {
+	l := NewLimiter(8, 2)
+	a, b := l.Bucket("a.example.com"), l.Bucket("b.example.com")
+	if a == b || l.Bucket("a.example.com") != a {
+		t.Fatal("want one bucket per host")
+	}
+	a.Backoff(0)
+	rates := l.Rates()
+	if len(rates) != 2 || rates["a.example.com"] != 4 || rates["b.example.com"] != 8 {
+		t.Fatalf("rates %v", rates)
+	}
+	var none *Limiter
+	none.Bucket("a.example.com").Wait()
+	if len(none.Rates()) != 0 {
+		t.Fatal("nil limiter has rates")
+	}
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+const (
+	Unlimited int64 = 0
+	Paused    int64 = -1
+)
+
+type Window struct {
+	From int
+	To   int
+	Rate int64
+}
+
+func (w Window) contains(minute int) bool {
+	if w.From <= w.To {
+		return minute >= w.From && minute < w.To
+	}
+	return minute >= w.From || minute < w.To
+}
+
+type Schedule struct {
+	Default int64
+	Windows []Window
+}
+
+// ParseSchedule reads entries such as "22:00-06:00=unlimited,200K", where
+// bare rates set the default and windows may wrap around midnight.
+func ParseSchedule(spec string) (Schedule, error) {
+	s := Schedule{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		span, value := "*", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			span, value = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		rate, err := parseRate(value)
+		if err != nil {
+			return s, err
+		}
+		if span == "*" {
+			s.Default = rate
+			continue
+		}
+		parts := strings.Split(span, "-")
+		if len(parts) != 2 {
+			return s, fmt.Errorf("invalid schedule window %q", span)
+		}
+		from, err := parseClock(parts[0])
+		if err != nil {
+			return s, err
+		}
+		to, err := parseClock(parts[1])
+		if err != nil {
+			return s, err
+		}
+		s.Windows = append(s.Windows, Window{From: from, To: to, Rate: rate})
+	}
+	return s, nil
+}
+
+func parseRate(value string) (int64, error) {
+	switch strings.ToLower(value) {
+	case "", "0", "unlimited", "full":
+		return Unlimited, nil
+	case "pause", "paused", "off":
+		return Paused, nil
+	}
+	n, err := bytefmt.ToBytes(strings.TrimSuffix(value, "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule rate %q", value)
+	}
+	return int64(n), nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule time %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s Schedule) Rate(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.Windows {
+		if w.contains(minute) {
+			return w.Rate
+		}
+	}
+	return s.Default
+}
@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleRate(t *testing.T) {
+	s, err := ParseSchedule("22:00-06:00=unlimited, 12:00-13:30=pause, 200K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2021, 3, 1, hour, minute, 59, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		t    time.Time
+		want int64
+	}{
+		{at(21, 59), 200 << 10},
+		{at(22, 0), Unlimited},
+		{at(23, 59), Unlimited},
+		{at(0, 0), Unlimited},
+		{at(5, 59), Unlimited},
+		{at(6, 0), 200 << 10},
+		{at(11, 59), 200 << 10},
+		{at(12, 0), Paused},
+		{at(13, 29), Paused},
+		{at(13, 30), 200 << 10},
+	} {
+		if got := s.Rate(c.t); got != c.want {
+			t.Errorf("%s: rate %d, want %d", c.t.Format("15:04:05"), got, c.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		want Schedule
+		err  bool
+	}{
+		{spec: "", want: Schedule{}},
+		{spec: "1M", want: Schedule{Default: 1 << 20}},
+		{spec: "512K/s", want: Schedule{Default: 512 << 10}},
+		{spec: "off", want: Schedule{Default: Paused}},
+		{spec: "18:00-00:00=100K", want: Schedule{Windows: []Window{{From: 18 * 60, To: 0, Rate: 100 << 10}}}},
+		{spec: "09:00-17:00=pause,full", want: Schedule{Windows: []Window{{From: 9 * 60, To: 17 * 60, Rate: Paused}}}},
+		{spec: "25:00-06:00=1M", err: true},
+		{spec: "22:00=1M", err: true},
+		{spec: "fast", err: true},
+	} {
+		got, err := ParseSchedule(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: no error", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+			continue
+		}
+		if got.Default != c.want.Default || len(got.Windows) != len(c.want.Windows) {
+			t.Errorf("%q: %+v, want %+v", c.spec, got, c.want)
+			continue
+		}
+		for i := range got.Windows {
+			if got.Windows[i] != c.want.Windows[i] {
+				t.Errorf("%q: %+v, want %+v", c.spec, got, c.want)
+			}
+		}
+	}
+}
+
+func TestBandwidthTake(t *testing.T) {
+	b := NewBandwidth(Schedule{Default: 100 << 10})
+	start := time.Now()
+	// the bucket starts empty, so 50K at 100K/s waits half a second
+	b.Take(50 << 10)
+	if d := time.Since(start); d < 400*time.Millisecond || d > time.Second {
+		t.Fatalf("50K at 100K/s took %v", d)
+	}
+	var none *Bandwidth
+	none.Take(1 << 30)
+	if none.Rate() != Unlimited {
+		t.Fatal("nil bandwidth is limited")
+	}
+}
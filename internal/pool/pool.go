@@ -1,27 +1,58 @@
 package pool
 
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type Job func()
 
+type ErrJob func() error
+
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("job panic: %v", e.Value)
+}
+
 type Worker struct {
 	WorkerPool chan chan Job
 	JobChannel chan Job
-	quit       chan bool
+	quit       chan struct{}
+	done       chan struct{}
+	once       sync.Once
 }
 
 func NewWorker(pool chan chan Job) *Worker {
 	return &Worker{
 		WorkerPool: pool,
 		JobChannel: make(chan Job),
-		quit:       make(chan bool),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
 func (w *Worker) Start() {
 	go func() {
+		defer close(w.done)
 		for {
-			w.WorkerPool <- w.JobChannel
+			select {
+			case w.WorkerPool <- w.JobChannel:
+			case <-w.quit:
+				return
+			}
 			select {
 			case job := <-w.JobChannel:
+				if job == nil {
+					return
+				}
 				job()
 			case <-w.quit:
 				return
@@ -31,33 +62,327 @@ func (w *Worker) Start() {
 }
 
 func (w *Worker) Stop() {
-	w.quit <- true
+	w.once.Do(func() {
+		close(w.quit)
+	})
+	<-w.done
 }
 
 type Dispatcher struct {
 	WorkerCap  int
-	JobQueue   chan Job
 	WorkerPool chan chan Job
+	OnError    func(err error)
+	// Deprecated: use Submit or SubmitErr. Jobs sent here directly still
+	// run, but Wait does not wait for them and Stop drops them unannounced.
+	JobQueue chan Job
+
+	mu       sync.RWMutex
+	started  bool
+	stopped  bool
+	jobQueue chan Job
+	pending  sync.WaitGroup
+	quit     chan struct{}
+	done     chan struct{}
+	exited   chan struct{}
+	once     sync.Once
+
+	sizeMu  sync.Mutex
+	workers []*Worker
+	retire  int
+	resized chan struct{}
+
+	jobsDone   int64
+	jobsFailed int64
+	jobsTime   int64
+	active     int64
 }
 
 func NewDispatcher(maxWorkers int, maxQueue int) *Dispatcher {
-	return &Dispatcher{maxWorkers, make(chan Job, maxQueue), make(chan chan Job, maxWorkers)}
+	return &Dispatcher{
+		WorkerCap:  maxWorkers,
+		WorkerPool: make(chan chan Job, maxWorkers),
+		JobQueue:   make(chan Job, maxQueue),
+		jobQueue:   make(chan Job, maxQueue),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		exited:     make(chan struct{}),
+		resized:    make(chan struct{}, 1),
+	}
 }
 
 func (d *Dispatcher) Run() {
-	for i := 0; i <= d.WorkerCap; i++ {
+	d.sizeMu.Lock()
+	for i := 0; i < d.WorkerCap; i++ {
 		worker := NewWorker(d.WorkerPool)
 		worker.Start()
+		d.workers = append(d.workers, worker)
 	}
+	d.started = true
+	d.sizeMu.Unlock()
 	go d.dispatch()
 }
 
+// Resize changes the number of workers; surplus workers retire as soon as
+// they are idle.
+func (d *Dispatcher) Resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	select {
+	case <-d.quit:
+		return
+	default:
+	}
+	if n > d.WorkerCap {
+		grow := n - d.WorkerCap
+		if d.retire > 0 {
+			keep := minInt(grow, d.retire)
+			d.retire -= keep
+			grow -= keep
+		}
+		if d.started {
+			for i := 0; i < grow; i++ {
+				worker := NewWorker(d.WorkerPool)
+				worker.Start()
+				d.workers = append(d.workers, worker)
+			}
+		}
+	} else if d.started {
+		d.retire += d.WorkerCap - n
+	}
+	d.WorkerCap = n
+	select {
+	case d.resized <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) Workers() int {
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	return d.WorkerCap
+}
+
+// Active returns the number of jobs running right now.
+func (d *Dispatcher) Active() int {
+	return int(atomic.LoadInt64(&d.active))
+}
+
+// Submit queues a job and reports false once the dispatcher is stopping.
+func (d *Dispatcher) Submit(job Job) bool {
+	return d.SubmitErr(func() error {
+		job()
+		return nil
+	})
+}
+
+// SubmitErr queues a job whose error, or recovered panic, is passed to
+// OnError on the worker goroutine.
+func (d *Dispatcher) SubmitErr(job ErrJob) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return false
+	}
+	d.pending.Add(1)
+	wrapped := func() {
+		defer d.pending.Done()
+		d.run(job)
+	}
+	select {
+	case d.jobQueue <- wrapped:
+		return true
+	case <-d.quit:
+		d.pending.Done()
+		return false
+	}
+}
+
+// Wait blocks until every submitted job has finished or been dropped.
+func (d *Dispatcher) Wait() {
+	d.pending.Wait()
+}
+
+// Stop aborts: queued jobs are dropped, running jobs finish, and all
+// workers have exited when it returns.
+func (d *Dispatcher) Stop() {
+	d.once.Do(func() {
+		close(d.quit)
+		d.mu.Lock()
+		d.stopped = true
+		d.mu.Unlock()
+		d.sizeMu.Lock()
+		started := d.started
+		d.sizeMu.Unlock()
+		if started {
+			<-d.done
+		}
+		d.sizeMu.Lock()
+		workers := d.workers
+		d.sizeMu.Unlock()
+	drain:
+		for {
+			select {
+			case <-d.jobQueue:
+				d.pending.Done()
+			case <-d.JobQueue:
+			default:
+				break drain
+			}
+		}
+		for _, w := range workers {
+			w.Stop()
+		}
+		close(d.exited)
+	})
+	<-d.exited
+}
+
+// Shutdown stops the dispatcher, first draining queued jobs when drain is
+// true. If ctx ends first the remaining jobs are aborted and ctx.Err() is
+// returned.
+func (d *Dispatcher) Shutdown(ctx context.Context, drain bool) error {
+	finished := make(chan struct{})
+	go func() {
+		if drain {
+			d.Wait()
+		}
+		d.Stop()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		go d.Stop()
+		return ctx.Err()
+	}
+}
+
 func (d *Dispatcher) dispatch() {
+	defer close(d.done)
 	for {
+		if d.retireOne() {
+			continue
+		}
 		select {
+		case job := <-d.jobQueue:
+			if !d.assign(job) {
+				d.pending.Done()
+				return
+			}
 		case job := <-d.JobQueue:
-			jobChannel := <-d.WorkerPool
-			jobChannel <- job
+			if !d.assign(func() {
+				d.run(func() error {
+					job()
+					return nil
+				})
+			}) {
+				return
+			}
+		case <-d.resized:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// assign hands job to the next idle worker and reports false if the
+// dispatcher stops first.
+func (d *Dispatcher) assign(job Job) bool {
+	select {
+	case jobChannel := <-d.WorkerPool:
+		select {
+		case jobChannel <- job:
+			return true
+		case <-d.quit:
+			return false
 		}
+	case <-d.quit:
+		return false
+	}
+}
+
+// run calls job on a worker, counting it in the stats and passing its
+// error to OnError.
+func (d *Dispatcher) run(job ErrJob) {
+	atomic.AddInt64(&d.active, 1)
+	start := time.Now()
+	err := call(job)
+	atomic.AddInt64(&d.active, -1)
+	atomic.AddInt64(&d.jobsTime, int64(time.Since(start)))
+	atomic.AddInt64(&d.jobsDone, 1)
+	if err == nil {
+		return
 	}
+	atomic.AddInt64(&d.jobsFailed, 1)
+	if d.OnError != nil {
+		d.OnError(err)
+	} else if p, ok := err.(*PanicError); ok {
+		fmt.Println(p, "\n"+string(p.Stack))
+	}
+}
+
+func (d *Dispatcher) retireOne() bool {
+	d.sizeMu.Lock()
+	retire := d.retire > 0
+	d.sizeMu.Unlock()
+	if !retire {
+		return false
+	}
+	select {
+	case jobChannel := <-d.WorkerPool:
+		d.sizeMu.Lock()
+		if d.retire > 0 {
+			d.retire--
+		} else {
+			worker := NewWorker(d.WorkerPool)
+			worker.Start()
+			d.workers = append(d.workers, worker)
+		}
+		d.sizeMu.Unlock()
+		select {
+		case jobChannel <- nil:
+		case <-d.quit:
+			return false
+		}
+		d.prune()
+		return true
+	case <-d.resized:
+		return true
+	case <-d.quit:
+		return false
+	}
+}
+
+func (d *Dispatcher) prune() {
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	workers := d.workers[:0]
+	for _, w := range d.workers {
+		select {
+		case <-w.done:
+		default:
+			workers = append(workers, w)
+		}
+	}
+	d.workers = workers
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func call(job ErrJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return job()
 }
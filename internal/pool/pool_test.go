@@ -0,0 +1,155 @@
+package pool
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// settle waits for goroutines that are on their way out and reports whether
+// the count got back to base.
+func settle(base int) (int, bool) {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > base; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	return n, n <= base
+}
+
+func TestRunWaitStopNoLeak(t *testing.T) {
+	base := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		d := NewDispatcher(8, 16)
+		d.Run()
+		var done int64
+		for j := 0; j < 100; j++ {
+			d.Submit(func() {
+				atomic.AddInt64(&done, 1)
+			})
+		}
+		d.Wait()
+		d.Stop()
+		if done != 100 {
+			t.Fatalf("run %d: %d of 100 jobs ran", i, done)
+		}
+	}
+	if n, ok := settle(base); !ok {
+		t.Fatalf("%d goroutines after repeated runs, %d before", n, base)
+	}
+}
+
+func TestRunStartsWorkerCap(t *testing.T) {
+	base := runtime.NumGoroutine()
+	d := NewDispatcher(5, 1)
+	d.Run()
+	defer d.Stop()
+	if len(d.workers) != 5 {
+		t.Fatalf("%d workers, want 5", len(d.workers))
+	}
+	// every idle worker offers its job channel once
+	for i := 0; i < 100 && len(d.WorkerPool) < 5; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(d.WorkerPool); n != 5 {
+		t.Fatalf("%d idle workers, want 5", n)
+	}
+	// the workers and the dispatch loop
+	if n := runtime.NumGoroutine() - base; n != 6 {
+		t.Fatalf("%d goroutines started, want 6", n)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	d := NewDispatcher(2, 64)
+	d.Run()
+	var done int64
+	for i := 0; i < 50; i++ {
+		d.Submit(func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&done, 1)
+		})
+	}
+	if err := d.Shutdown(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if done != 50 {
+		t.Fatalf("%d of 50 queued jobs ran", done)
+	}
+	if d.Submit(func() {}) {
+		t.Fatal("submit accepted after shutdown")
+	}
+}
+
+func TestShutdownExpiredContext(t *testing.T) {
+	base := runtime.NumGoroutine()
+	d := NewDispatcher(1, 64)
+	d.Run()
+	release := make(chan struct{})
+	var done int64
+	for i := 0; i < 10; i++ {
+		d.Submit(func() {
+			<-release
+			atomic.AddInt64(&done, 1)
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Shutdown(ctx, true); err != context.Canceled {
+		t.Fatalf("Shutdown = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	d.Stop()
+	d.Wait()
+	if done == 10 {
+		t.Fatal("queued jobs ran after the context expired")
+	}
+	if n, ok := settle(base); !ok {
+		t.Fatalf("%d goroutines after shutdown, %d before", n, base)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	d := NewDispatcher(2, 8)
+	d.Run()
+	ran := make(chan struct{}, 8)
+	for i := 0; i < 8; i++ {
+		d.JobQueue <- func() {
+			ran <- struct{}{}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-ran:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of 8 jobs sent to JobQueue ran", i)
+		}
+	}
+	// jobs still queued are dropped without touching the Wait count
+	block := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		d.JobQueue <- func() {
+			<-block
+		}
+	}
+	close(block)
+	d.Stop()
+	d.Wait()
+}
+
+func TestResizeWhileStarting(t *testing.T) {
+	d := NewDispatcher(2, 8)
+	resized := make(chan struct{})
+	go func() {
+		d.Resize(4)
+		close(resized)
+	}()
+	d.Run()
+	<-resized
+	defer d.Stop()
+	if n := d.Workers(); n != 4 {
+		t.Fatalf("%d workers, want 4", n)
+	}
+}
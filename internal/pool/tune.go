@@ -0,0 +1,69 @@
+package pool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type Stats struct {
+	Workers int
+	Done    int64
+	Failed  int64
+	Latency time.Duration
+}
+
+// Stats returns and resets the job counters collected since the last call.
+func (d *Dispatcher) Stats() Stats {
+	s := Stats{
+		Workers: d.Workers(),
+		Done:    atomic.SwapInt64(&d.jobsDone, 0),
+		Failed:  atomic.SwapInt64(&d.jobsFailed, 0),
+	}
+	if total := atomic.SwapInt64(&d.jobsTime, 0); s.Done != 0 {
+		s.Latency = time.Duration(total / s.Done)
+	}
+	return s
+}
+
+// AutoTune grows the worker count while throughput improves and backs off
+// when latency or the error rate climbs, staying within [min, max].
+func (d *Dispatcher) AutoTune(min, max int, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastRate float64
+		var lastLatency time.Duration
+		for {
+			select {
+			case <-ticker.C:
+			case <-d.quit:
+				return
+			}
+			s := d.Stats()
+			if s.Done == 0 {
+				continue
+			}
+			rate := float64(s.Done) / interval.Seconds()
+			errRate := float64(s.Failed) / float64(s.Done)
+			n := s.Workers
+			switch {
+			case errRate > 0.1 || (lastLatency > 0 && s.Latency > lastLatency*3/2):
+				n = n * 3 / 4
+			case rate > lastRate*1.05:
+				n += n/4 + 1
+			case rate < lastRate*0.9:
+				n = n * 9 / 10
+			}
+			if n < min {
+				n = min
+			}
+			if n > max {
+				n = max
+			}
+			if n != s.Workers {
+				d.Resize(n)
+			}
+			lastRate, lastLatency = rate, s.Latency
+		}
+	}()
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ctxKey struct{}
+
+type entry struct {
+	url     *url.URL
+	fails   int
+	ejected time.Time
+}
+
+type Pool struct {
+	mu       sync.Mutex
+	entries  []*entry
+	next     int
+	maxFails int
+	cooldown time.Duration
+}
+
+func NewPool(proxies []string, maxFails int, cooldown time.Duration) (*Pool, error) {
+	p := &Pool{maxFails: maxFails, cooldown: cooldown}
+	for _, v := range proxies {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		p.entries = append(p.entries, &entry{url: u})
+	}
+	return p, nil
+}
+
+func (p *Pool) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.entries)
+}
+
+func (p *Pool) Next() *url.URL {
+	if p.Len() == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var oldest *entry
+	for i := 0; i < len(p.entries); i++ {
+		e := p.entries[p.next]
+		p.next = (p.next + 1) % len(p.entries)
+		if e.ejected.IsZero() || now.Sub(e.ejected) >= p.cooldown {
+			if !e.ejected.IsZero() {
+				e.ejected = now
+			}
+			return e.url
+		}
+		if oldest == nil || e.ejected.Before(oldest.ejected) {
+			oldest = e
+		}
+	}
+	return oldest.url
+}
+
+func (p *Pool) Report(u *url.URL, err error) {
+	if u == nil || p.Len() == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		if e.url != u {
+			continue
+		}
+		if err == nil {
+			e.fails = 0
+			e.ejected = time.Time{}
+			return
+		}
+		e.fails++
+		if e.fails >= p.maxFails {
+			e.ejected = time.Now()
+		}
+		return
+	}
+}
+
+func (p *Pool) Alive() (alive, total int) {
+	if p.Len() == 0 {
+		return 0, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		if e.ejected.IsZero() {
+			alive++
+		}
+	}
+	return alive, len(p.entries)
+}
+
+func WithProxy(ctx context.Context, u *url.URL) context.Context {
+	return context.WithValue(ctx, ctxKey{}, u)
+}
+
+func FromRequest(req *http.Request) (*url.URL, error) {
+	if u, ok := req.Context().Value(ctxKey{}).(*url.URL); ok && u != nil {
+		return u, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func hosts(p *Pool, n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		got = append(got, p.Next().Host)
+	}
+	return got
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPoolEjectsFailingProxy(t *testing.T) {
+	p, err := NewPool([]string{"http://a:8080", " socks5://b:1080 ", "", "https://c:8443"}, 2, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hosts(p, 4); !equal(got, []string{"a:8080", "b:1080", "c:8443", "a:8080"}) {
+		t.Fatalf("rotation %v", got)
+	}
+	b := p.entries[1].url
+	failed := errors.New("connection refused")
+
+	// one failure is forgiven
+	p.Report(b, failed)
+	if alive, total := p.Alive(); alive != 3 || total != 3 {
+		t.Fatalf("%d of %d alive after one failure", alive, total)
+	}
+	p.Report(b, failed)
+	if alive, _ := p.Alive(); alive != 2 {
+		t.Fatalf("%d alive after %d failures, want b ejected", alive, 2)
+	}
+	for _, host := range hosts(p, 6) {
+		if host == "b:1080" {
+			t.Fatal("ejected proxy handed out during its cooldown")
+		}
+	}
+
+	// after the cooldown it gets another try, and a success brings it back
+	time.Sleep(120 * time.Millisecond)
+	if got := hosts(p, 3); !equal(got, []string{"b:1080", "c:8443", "a:8080"}) {
+		t.Fatalf("rotation after cooldown %v", got)
+	}
+	p.Report(b, nil)
+	if alive, _ := p.Alive(); alive != 3 {
+		t.Fatalf("%d alive after b recovered", alive)
+	}
+}
+
+func TestPoolAllEjected(t *testing.T) {
+	p, err := NewPool([]string{"http://a:8080", "http://b:8080"}, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, a := p.entries[1].url, p.entries[0].url
+	p.Report(b, errors.New("timeout"))
+	time.Sleep(time.Millisecond)
+	p.Report(a, errors.New("proxy authentication required"))
+	// the one ejected longest ago is still better than nothing
+	if got := p.Next(); got != b {
+		t.Fatalf("got %v, want the proxy ejected first", got)
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	if _, err := NewPool([]string{"ftp://a:21"}, 1, time.Second); err == nil {
+		t.Fatal("accepted an ftp proxy")
+	}
+	var none *Pool
+	if none.Next() != nil || none.Len() != 0 {
+		t.Fatal("nil pool hands out proxies")
+	}
+	none.Report(nil, errors.New("ignored"))
+}
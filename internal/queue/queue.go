@@ -0,0 +1,428 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mapdownloader/config"
+	"mapdownloader/internal/downloader"
+	"mapdownloader/internal/hook"
+	"mapdownloader/internal/limiter"
+	"mapdownloader/internal/proxy"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type State string
+
+const (
+	Queued  State = "queued"
+	Running State = "running"
+	Done    State = "done"
+	Failed  State = "failed"
+)
+
+type Job struct {
+	ID       int64
+	Name     string
+	Info     downloader.MapInfo
+	State    State
+	Workers  int
+	Total    int64
+	Done     int64
+	Failed   int64
+	Err      string
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+	Options  Options
+}
+
+// Options are the download settings a job keeps besides its MapInfo.
+type Options struct {
+	Schedule string   `json:"schedule,omitempty"`
+	Proxies  []string `json:"proxies,omitempty"`
+	// Hooks replace config.HOOKS when not nil; an empty list runs none.
+	Hooks []config.Hook `json:"hooks"`
+}
+
+func (o Options) validate() error {
+	if o.Schedule != "" {
+		if _, err := limiter.ParseSchedule(o.Schedule); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if len(o.Proxies) != 0 {
+		if _, err := proxy.NewPool(o.Proxies, config.PROXY_MAX_FAILS, 0); err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+	}
+	return nil
+}
+
+func (o Options) apply(dl *downloader.DownLoader) error {
+	if o.Schedule != "" {
+		if err := dl.SetSchedule(o.Schedule); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if len(o.Proxies) != 0 {
+		if err := dl.SetProxies(o.Proxies); err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+	}
+	return nil
+}
+
+// Queue runs MapInfo jobs in the order they were added. Jobs start while
+// their workers fit in Budget, one at a time per database file. The jobs
+// table keeps the queue across restarts; a running job belongs to the
+// process that refreshes its heartbeat.
+type Queue struct {
+	Budget int
+	// Log receives the log lines of the queue and its downloads.
+	Log io.Writer
+
+	db      *sql.DB
+	owner   string
+	mu      sync.Mutex
+	running map[int64]*downloader.DownLoader
+	workers map[int64]int
+	changed chan struct{}
+}
+
+// Open loads the queue at path. It leaves running jobs alone, they may
+// belong to another process; Run queues them again once their lease ends.
+func Open(path string) (*Queue, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(config.JobTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Queue{
+		Budget:  config.QUEUE_BUDGET,
+		Log:     os.Stdout,
+		db:      db,
+		owner:   fmt.Sprintf("%s/%d", host, os.Getpid()),
+		running: make(map[int64]*downloader.DownLoader),
+		workers: make(map[int64]int),
+		changed: make(chan struct{}, 1),
+	}, nil
+}
+
+func migrate(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(jobs)")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var def sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, column := range config.JOB_COLUMNS {
+		if existing[strings.Fields(column)[0]] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE jobs ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Add queues info under name with opts; workers <= 0 takes the whole budget.
+func (q *Queue) Add(name string, info downloader.MapInfo, workers int, opts Options) (int64, error) {
+	if err := info.Validate(); err != nil {
+		return 0, err
+	}
+	if info.DbPath == "" {
+		return 0, fmt.Errorf("job has no database path")
+	}
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return 0, err
+	}
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return 0, err
+	}
+	res, err := q.db.Exec("INSERT INTO jobs(name,info,state,workers,created,options) VALUES(?,?,?,?,?,?)",
+		name, string(data), Queued, workers, time.Now().Unix(), string(options))
+	if err != nil {
+		return 0, err
+	}
+	q.notify()
+	return res.LastInsertId()
+}
+
+// Retry queues a failed or finished job again.
+func (q *Queue) Retry(id int64) error {
+	return q.setState(id, Queued, "state<>?", Running)
+}
+
+// Remove deletes a job that is not running.
+func (q *Queue) Remove(id int64) error {
+	res, err := q.db.Exec("DELETE FROM jobs WHERE id=? AND state<>?", id, Running)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("job %d not found or running", id)
+	}
+	return nil
+}
+
+func (q *Queue) setState(id int64, state State, where string, args ...interface{}) error {
+	res, err := q.db.Exec("UPDATE jobs SET state=?,error='',started=0,finished=0 WHERE id=? AND "+where,
+		append([]interface{}{state, id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("job %d not found or running", id)
+	}
+	q.notify()
+	return nil
+}
+
+// Jobs lists every job; running jobs carry their live counts.
+func (q *Queue) Jobs() ([]Job, error) {
+	rows, err := q.db.Query("SELECT id,name,info,state,workers,total,done,failed,error,created,started,finished,options FROM jobs ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]Job, 0)
+	for rows.Next() {
+		j := Job{}
+		var info, options string
+		var created, started, finished int64
+		if err := rows.Scan(&j.ID, &j.Name, &info, &j.State, &j.Workers, &j.Total, &j.Done, &j.Failed, &j.Err, &created, &started, &finished, &options); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(info), &j.Info); err != nil {
+			j.Err = "bad job info: " + err.Error()
+		}
+		if options != "" {
+			if err := json.Unmarshal([]byte(options), &j.Options); err != nil {
+				j.Err = "bad job options: " + err.Error()
+			}
+		}
+		j.Created = unix(created)
+		j.Started = unix(started)
+		j.Finished = unix(finished)
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, j := range jobs {
+		if dl, ok := q.running[j.ID]; ok {
+			p := dl.Progress()
+			jobs[i].Done, jobs[i].Failed = p.Done+p.Skipped, p.Failed
+			if p.Total != 0 {
+				jobs[i].Total = p.Total
+			}
+		}
+	}
+	return jobs, nil
+}
+
+func unix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (j Job) Percent() float64 {
+	if j.Total == 0 {
+		return 0
+	}
+	return float64(j.Done+j.Failed) / float64(j.Total)
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts queued jobs as the budget allows and returns once nothing is
+// queued or running, or when stop is closed. While it runs it renews the
+// lease of its jobs and queues again the jobs of runners whose lease ended.
+func (q *Queue) Run(stop <-chan struct{}) error {
+	lease := time.Duration(config.QUEUE_LEASE) * time.Second
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		if err := q.beat(); err != nil {
+			return err
+		}
+		if err := q.recoverStale(lease); err != nil {
+			return err
+		}
+		started, err := q.schedule()
+		if err != nil {
+			return err
+		}
+		q.mu.Lock()
+		idle := len(q.running) == 0
+		q.mu.Unlock()
+		if idle && !started {
+			// wait for the jobs of other runners: they finish, or their
+			// lease ends and they are queued again
+			var others int
+			if err := q.db.QueryRow("SELECT COUNT(*) FROM jobs WHERE state=?", Running).Scan(&others); err != nil {
+				return err
+			}
+			if others == 0 {
+				return nil
+			}
+		}
+		select {
+		case <-q.changed:
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// beat renews the lease of the jobs this process runs.
+func (q *Queue) beat() error {
+	_, err := q.db.Exec("UPDATE jobs SET heartbeat=? WHERE state=? AND owner=?", time.Now().Unix(), Running, q.owner)
+	return err
+}
+
+// recoverStale queues the running jobs whose runner stopped renewing them.
+func (q *Queue) recoverStale(lease time.Duration) error {
+	_, err := q.db.Exec("UPDATE jobs SET state=?,started=0,owner='' WHERE state=? AND heartbeat<? AND owner<>?",
+		Queued, Running, time.Now().Add(-lease).Unix(), q.owner)
+	return err
+}
+
+func (q *Queue) schedule() (bool, error) {
+	jobs, err := q.Jobs()
+	if err != nil {
+		return false, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := 0
+	busy := make(map[string]bool)
+	for _, j := range jobs {
+		if _, ok := q.running[j.ID]; ok {
+			used += q.workers[j.ID]
+		}
+		if j.State == Running {
+			busy[j.Info.DbPath] = true
+		}
+	}
+	started := false
+	for _, j := range jobs {
+		if j.State != Queued || busy[j.Info.DbPath] {
+			continue
+		}
+		workers := j.Workers
+		if workers <= 0 || workers > q.Budget {
+			workers = q.Budget
+		}
+		if used+workers > q.Budget {
+			// keep the order: later jobs wait for this one
+			break
+		}
+		// claim the job, another runner may have taken it since Jobs
+		now := time.Now().Unix()
+		res, err := q.db.Exec("UPDATE jobs SET state=?,error='',started=?,finished=0,owner=?,heartbeat=? WHERE id=? AND state=?",
+			Running, now, q.owner, now, j.ID, Queued)
+		if err != nil {
+			return started, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		used += workers
+		busy[j.Info.DbPath] = true
+		dl := downloader.NewDownLoader(j.Info, 4096, 4096, workers)
+		dl.SetLog(q.Log)
+		q.running[j.ID] = dl
+		q.workers[j.ID] = workers
+		started = true
+		go q.run(j, dl)
+	}
+	return started, nil
+}
+
+func (q *Queue) run(j Job, dl *downloader.DownLoader) {
+	state, msg := Done, ""
+	if err := j.Options.apply(dl); err != nil {
+		state, msg = Failed, err.Error()
+	} else if dl.GetTaskInfo() == 0 {
+		state, msg = Failed, "no tiles in the selected area"
+	} else if err := dl.Preflight(); err != nil && config.DISK_STRICT {
+		state, msg = Failed, err.Error()
+	} else if !dl.Start() {
+		state, msg = Failed, "download did not start"
+	}
+	p := dl.Progress()
+	if state == Done && p.Done == 0 && p.Failed != 0 {
+		state, msg = Failed, fmt.Sprintf("all %d tiles failed", p.Failed)
+	}
+	hooks := config.HOOKS
+	if j.Options.Hooks != nil {
+		hooks = j.Options.Hooks
+	}
+	if state == Done {
+		for _, r := range hook.Run(hooks, &hook.Summary{DbPath: j.Info.DbPath, Info: j.Info, Progress: p}) {
+			if r.Err != nil {
+				msg = r.String()
+			}
+		}
+	}
+
+	q.mu.Lock()
+	delete(q.running, j.ID)
+	delete(q.workers, j.ID)
+	q.mu.Unlock()
+	if _, err := q.db.Exec("UPDATE jobs SET state=?,total=?,done=?,failed=?,error=?,finished=? WHERE id=? AND owner=?",
+		state, p.Total, p.Done+p.Skipped, p.Failed, msg, time.Now().Unix(), j.ID, q.owner); err != nil {
+		fmt.Fprintln(q.Log, "save job err", err)
+	}
+	q.notify()
+}
@@ -0,0 +1,455 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mapdownloader/internal/pool"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrChecksum = errors.New("uploaded object does not match the local file")
+
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	MD5    string `json:"md5"`
+}
+
+// uploadState is kept next to the file while a multipart upload runs so an
+// interrupted upload continues with the parts that are missing.
+type uploadState struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"uploadId"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"modTime"`
+	PartSize int64  `json:"partSize"`
+	Parts    []Part `json:"parts"`
+}
+
+type UploadResult struct {
+	URL     *url.URL
+	ETag    string
+	Size    int64
+	Parts   int
+	Resumed int
+}
+
+// Upload sends the file at path as key, in parts when it is at least
+// Multipart bytes, and checks the size and ETag the store reports against
+// the local file.
+func (c *Client) Upload(ctx context.Context, key, path string) (UploadResult, error) {
+	result := UploadResult{}
+	info, err := os.Stat(path)
+	if err != nil {
+		return result, err
+	}
+	result.Size = info.Size()
+	var etag string
+	if info.Size() < c.Multipart {
+		if result.URL, err = c.PutFile(ctx, key, path); err != nil {
+			return result, err
+		}
+		if etag, err = fileMD5(path); err != nil {
+			return result, err
+		}
+		result.Parts = 1
+	} else {
+		state := c.loadState(ctx, path, key, info)
+		key = state.Key
+		if etag, result.Parts, result.Resumed, err = c.multipart(ctx, state, path, info); err != nil {
+			return result, err
+		}
+		result.URL, _ = c.URL(key, nil)
+	}
+	result.ETag = etag
+	return result, c.verify(ctx, key, result.Size, etag)
+}
+
+// StatePath is the file that records the parts of an unfinished upload of
+// path.
+func StatePath(path string) string {
+	return path + ".upload"
+}
+
+func (c *Client) multipart(ctx context.Context, state *uploadState, path string, info os.FileInfo) (etag string, parts, resumed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer f.Close()
+
+	done := make(map[int]Part)
+	if state.UploadID != "" {
+		if done, err = c.listParts(ctx, state); err != nil {
+			// the upload expired or was aborted: start again
+			state.UploadID, state.Parts = "", nil
+			done = make(map[int]Part)
+		}
+	}
+	if state.UploadID == "" {
+		if state.UploadID, err = c.createUpload(ctx, state.Key); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	count := int((info.Size() + state.PartSize - 1) / state.PartSize)
+	var mu sync.Mutex
+	var firstErr error
+	kept := make([]Part, 0, count)
+	for _, p := range state.Parts {
+		if remote, ok := done[p.Number]; ok && strings.Trim(remote.ETag, `"`) == p.MD5 {
+			kept = append(kept, p)
+		}
+	}
+	state.Parts = kept
+	resumed = len(kept)
+	have := make(map[int]bool)
+	for _, p := range kept {
+		have[p.Number] = true
+	}
+	c.saveState(path, state)
+
+	workers := pool.NewDispatcher(c.Workers, count)
+	workers.OnError = func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	workers.Run()
+	for n := 1; n <= count; n++ {
+		if have[n] {
+			continue
+		}
+		n := n
+		offset := int64(n-1) * state.PartSize
+		size := state.PartSize
+		if offset+size > info.Size() {
+			size = info.Size() - offset
+		}
+		workers.SubmitErr(func() error {
+			part, err := c.uploadPart(ctx, state, n, io.NewSectionReader(f, offset, size))
+			if err != nil {
+				return fmt.Errorf("part %d: %v", n, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			state.Parts = append(state.Parts, part)
+			c.saveState(path, state)
+			return nil
+		})
+	}
+	workers.Wait()
+	workers.Stop()
+	if firstErr != nil {
+		return "", 0, resumed, firstErr
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return state.Parts[i].Number < state.Parts[j].Number
+	})
+	if err := c.completeUpload(ctx, state); err != nil {
+		return "", 0, resumed, err
+	}
+	os.Remove(StatePath(path))
+	return multipartETag(state.Parts), count, resumed, nil
+}
+
+// loadState returns the state of an unfinished upload of the file at path,
+// or a fresh one. A resumed upload keeps the key it started with, as key may
+// have expanded differently since, e.g. {date} after midnight; an upload of
+// an older version of the file is aborted so its parts are not left behind.
+func (c *Client) loadState(ctx context.Context, path, key string, info os.FileInfo) *uploadState {
+	fresh := &uploadState{
+		Bucket:   c.Bucket,
+		Key:      key,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		PartSize: c.PartSize,
+	}
+	data, err := ioutil.ReadFile(StatePath(path))
+	if err != nil {
+		return fresh
+	}
+	state := &uploadState{}
+	if json.Unmarshal(data, state) != nil || state.Bucket != fresh.Bucket {
+		return fresh
+	}
+	if state.Size != fresh.Size || state.ModTime != fresh.ModTime || state.PartSize <= 0 {
+		if state.UploadID != "" {
+			if err := c.abortUpload(ctx, state); err != nil {
+				fmt.Fprintln(os.Stderr, "abort stale upload err", err)
+			}
+		}
+		return fresh
+	}
+	return state
+}
+
+func (c *Client) saveState(path string, state *uploadState) {
+	data, _ := json.Marshal(state)
+	if err := ioutil.WriteFile(StatePath(path), data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "save upload state err", err)
+	}
+}
+
+func (c *Client) createUpload(ctx context.Context, key string) (string, error) {
+	u, err := c.URL(key, url.Values{"uploads": {""}})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := c.doXML(req, emptyHash, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("no upload id in response")
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) listParts(ctx context.Context, state *uploadState) (map[int]Part, error) {
+	parts := make(map[int]Part)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {state.UploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		u, err := c.URL(state.Key, query)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+			IsTruncated          bool
+			NextPartNumberMarker string
+		}{}
+		if err := c.doXML(req, emptyHash, &result); err != nil {
+			return nil, err
+		}
+		for _, p := range result.Parts {
+			parts[p.PartNumber] = Part{Number: p.PartNumber, ETag: p.ETag}
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// uploadPart sends one part with its md5 and sha256 so the store rejects
+// a part that was damaged on the way.
+func (c *Client) uploadPart(ctx context.Context, state *uploadState, n int, r *io.SectionReader) (Part, error) {
+	md5sum, sha := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5sum, sha), r); err != nil {
+		return Part{}, err
+	}
+	part := Part{Number: n, MD5: hex.EncodeToString(md5sum.Sum(nil))}
+	payloadHash := hex.EncodeToString(sha.Sum(nil))
+
+	u, err := c.URL(state.Key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {state.UploadID}})
+	if err != nil {
+		return part, err
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			return part, err
+		}
+		req.ContentLength = r.Size()
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum.Sum(nil)))
+		resp, err := c.do(req, payloadHash)
+		if err == nil {
+			part.ETag = resp.Header.Get("ETag")
+			resp.Body.Close()
+			return part, nil
+		}
+		if attempt+1 >= c.Retry {
+			return part, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		case <-ctx.Done():
+			return part, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) completeUpload(ctx context.Context, state *uploadState) error {
+	type completePart struct {
+		PartNumber int
+		ETag       string
+	}
+	body := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{}
+	for _, p := range state.Parts {
+		body.Parts = append(body.Parts, completePart{p.Number, p.ETag})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u, err := c.URL(state.Key, url.Values{"uploadId": {state.UploadID}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	// a 200 response can still carry an error document
+	result := struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}{}
+	if err := c.doXML(req, hashHex(data), &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return &Error{http.StatusOK, result.Code + ": " + result.Message}
+	}
+	return nil
+}
+
+// Abort discards the parts of an unfinished upload of path.
+func (c *Client) Abort(ctx context.Context, path string) error {
+	data, err := ioutil.ReadFile(StatePath(path))
+	if err != nil {
+		return err
+	}
+	state := &uploadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+	if err := c.abortUpload(ctx, state); err != nil {
+		return err
+	}
+	return os.Remove(StatePath(path))
+}
+
+func (c *Client) abortUpload(ctx context.Context, state *uploadState) error {
+	u, err := c.URL(state.Key, url.Values{"uploadId": {state.UploadID}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) verify(ctx context.Context, key string, size int64, etag string) error {
+	u, err := c.URL(key, nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.ContentLength != size {
+		return fmt.Errorf("%w: size %d, local %d", ErrChecksum, resp.ContentLength, size)
+	}
+	// SSE-KMS and some self-hosted stores give ETags that are not an md5,
+	// leaving only the size to compare
+	remote := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if !md5ETag(resp.Header, remote) {
+		return nil
+	}
+	if !strings.EqualFold(remote, etag) {
+		return fmt.Errorf("%w: etag %s, local %s", ErrChecksum, remote, etag)
+	}
+	return nil
+}
+
+var md5ETagPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}(-[0-9]+)?$`)
+
+// md5ETag reports whether etag is the md5 of the object, or of its parts.
+func md5ETag(header http.Header, etag string) bool {
+	if header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" {
+		return false
+	}
+	return md5ETagPattern.MatchString(etag)
+}
+
+func (c *Client) doXML(req *http.Request, payloadHash string, v interface{}) error {
+	resp, err := c.do(req, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// multipartETag is the ETag S3 gives a multipart object: the md5 of the
+// part md5s followed by the part count.
+func multipartETag(parts []Part) string {
+	h := md5.New()
+	for _, p := range parts {
+		sum, _ := hex.DecodeString(p.MD5)
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,381 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 keeps objects and multipart uploads in memory and checks the
+// signature headers of every request.
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string][]byte
+	etags    map[string]string
+	uploads  map[string]map[int][]byte
+	keys     map[string]string
+	aborted  []string
+	puts     map[int]int
+	next     int
+	failPart int
+	// kms answers HEAD like an SSE-KMS bucket, with an ETag that is not
+	// the md5 of the object
+	kms bool
+	// truncate drops the last byte of every object
+	truncate bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Client) {
+	f := &fakeS3{
+		t:       t,
+		objects: make(map[string][]byte),
+		etags:   make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+		keys:    make(map[string]string),
+		puts:    make(map[int]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c := NewClient(srv.URL, "", "tiles", "AK", "SK")
+	c.PathStyle = true
+	c.Multipart = 10
+	c.PartSize = 4
+	c.Workers = 2
+	c.Retry = 1
+	return f, c
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") {
+		f.t.Errorf("%s %s: authorization %q", r.Method, r.URL, r.Header.Get("Authorization"))
+	}
+	if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		f.t.Errorf("%s %s: payload hash does not match the body", r.Method, r.URL)
+	}
+	if m := r.Header.Get("Content-MD5"); m != "" {
+		if sum := md5.Sum(body); m != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+	}
+	if !strings.HasPrefix(r.URL.Path, "/tiles/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/tiles/")
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[id]
+	if id != "" && (!ok || f.keys[id] != key) {
+		http.Error(w, "NoSuchUpload", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == "PUT" && id != "":
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.puts[n]++
+		if n == f.failPart {
+			http.Error(w, "InternalError", http.StatusInternalServerError)
+			return
+		}
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == "PUT":
+		f.store(key, body, fmt.Sprintf("%x", md5.Sum(body)))
+	case r.Method == "POST" && query["uploads"] != nil:
+		f.next++
+		id = "upload-" + strconv.Itoa(f.next)
+		f.uploads[id] = make(map[int][]byte)
+		f.keys[id] = key
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "GET" && id != "":
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult>")
+		for _, n := range numbers {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>&quot;%x&quot;</ETag></Part>", n, md5.Sum(parts[n]))
+		}
+		fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListPartsResult>")
+	case r.Method == "POST" && id != "":
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, "MalformedXML", http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		sums := md5.New()
+		for _, p := range complete.Parts {
+			sum := md5.Sum(parts[p.PartNumber])
+			if strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum[:]) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>etag</Message></Error>")
+				return
+			}
+			data = append(data, parts[p.PartNumber]...)
+			sums.Write(sum[:])
+		}
+		f.store(key, data, fmt.Sprintf("%x-%d", sums.Sum(nil), len(complete.Parts)))
+		delete(f.uploads, id)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && id != "":
+		delete(f.uploads, id)
+		f.aborted = append(f.aborted, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := f.etags[key]
+		if f.kms {
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+			sum := md5.Sum(append([]byte("kms"), data...))
+			etag = hex.EncodeToString(sum[:])
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) store(key string, data []byte, etag string) {
+	if f.truncate {
+		data = data[:len(data)-1]
+	}
+	f.objects[key] = data
+	f.etags[key] = etag
+}
+
+func testFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUploadSingle(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "small")
+	result, err := c.Upload(context.Background(), "maps/small.db", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Parts != 1 || result.Size != 5 || string(f.objects["maps/small.db"]) != "small" {
+		t.Fatalf("result %+v, stored %q", result, f.objects["maps/small.db"])
+	}
+	if result.URL.Path != "/tiles/maps/small.db" {
+		t.Fatalf("url %s", result.URL)
+	}
+}
+
+func TestUploadParts(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "0123456789")
+	result, err := c.Upload(context.Background(), "tiles.db", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 bytes in parts of 4
+	if result.Parts != 3 || result.Resumed != 0 {
+		t.Fatalf("result %+v, want 3 new parts", result)
+	}
+	if string(f.objects["tiles.db"]) != "0123456789" {
+		t.Fatalf("stored %q", f.objects["tiles.db"])
+	}
+	if result.ETag != f.etags["tiles.db"] || !strings.HasSuffix(result.ETag, "-3") {
+		t.Fatalf("etag %s, store has %s", result.ETag, f.etags["tiles.db"])
+	}
+	if _, err := os.Stat(StatePath(path)); !os.IsNotExist(err) {
+		t.Fatalf("state file left behind: %v", err)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "0123456789")
+	f.failPart = 3
+	if _, err := c.Upload(context.Background(), "maps/2021-01-01.db", path); err == nil {
+		t.Fatal("upload with a failing part succeeded")
+	}
+	if _, err := os.Stat(StatePath(path)); err != nil {
+		t.Fatalf("no state after a failed upload: %v", err)
+	}
+
+	// the key expands differently the next day, the upload goes on under
+	// the key it started with
+	f.failPart = 0
+	result, err := c.Upload(context.Background(), "maps/2021-01-02.db", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed != 2 || result.Parts != 3 {
+		t.Fatalf("result %+v, want 2 of 3 parts resumed", result)
+	}
+	if f.puts[1] != 1 || f.puts[2] != 1 || f.puts[3] != 2 {
+		t.Fatalf("part uploads %v, want only part 3 sent again", f.puts)
+	}
+	if string(f.objects["maps/2021-01-01.db"]) != "0123456789" {
+		t.Fatalf("objects %v, want the original key", f.objects)
+	}
+	if _, ok := f.objects["maps/2021-01-02.db"]; ok {
+		t.Fatal("resumed upload stored under the new key")
+	}
+	if result.URL.Path != "/tiles/maps/2021-01-01.db" {
+		t.Fatalf("url %s", result.URL)
+	}
+}
+
+func TestUploadRestartsExpired(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "0123456789")
+	f.failPart = 3
+	c.Upload(context.Background(), "tiles.db", path)
+	// the store dropped the unfinished upload
+	f.uploads = make(map[string]map[int][]byte)
+	f.failPart = 0
+	result, err := c.Upload(context.Background(), "tiles.db", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed != 0 || string(f.objects["tiles.db"]) != "0123456789" {
+		t.Fatalf("result %+v, stored %q", result, f.objects["tiles.db"])
+	}
+}
+
+func TestUploadAbortsStale(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "0123456789")
+	f.failPart = 3
+	c.Upload(context.Background(), "tiles.db", path)
+	data, err := ioutil.ReadFile(StatePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := uploadState{}
+	if err := json.Unmarshal(data, &stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file changed since
+	if err := ioutil.WriteFile(path, []byte("abcdefghijklmn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.failPart = 0
+	result, err := c.Upload(context.Background(), "tiles.db", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.aborted) != 1 || f.aborted[0] != stale.UploadID {
+		t.Fatalf("aborted %v, want %s", f.aborted, stale.UploadID)
+	}
+	if result.Resumed != 0 || string(f.objects["tiles.db"]) != "abcdefghijklmn" {
+		t.Fatalf("result %+v, stored %q", result, f.objects["tiles.db"])
+	}
+}
+
+func TestAbort(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "0123456789")
+	f.failPart = 3
+	c.Upload(context.Background(), "tiles.db", path)
+	if err := c.Abort(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.aborted) != 1 || len(f.uploads) != 0 {
+		t.Fatalf("aborted %v, open uploads %d", f.aborted, len(f.uploads))
+	}
+	if _, err := os.Stat(StatePath(path)); !os.IsNotExist(err) {
+		t.Fatalf("state file left behind: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, e := range []struct {
+		name     string
+		data     string
+		kms      bool
+		truncate bool
+		ok       bool
+	}{
+		{name: "single", data: "small", ok: true},
+		{name: "multipart", data: "0123456789", ok: true},
+		{name: "short object", data: "small", truncate: true},
+		{name: "short multipart object", data: "0123456789", truncate: true},
+		{name: "kms", data: "small", kms: true, ok: true},
+		{name: "kms multipart", data: "0123456789", kms: true, ok: true},
+		{name: "kms short object", data: "small", kms: true, truncate: true},
+	} {
+		f, c := newFakeS3(t)
+		f.kms, f.truncate = e.kms, e.truncate
+		_, err := c.Upload(context.Background(), "tiles.db", testFile(t, e.data))
+		if e.ok && err != nil {
+			t.Errorf("%s: %v", e.name, err)
+		}
+		if !e.ok && !errors.Is(err, ErrChecksum) {
+			t.Errorf("%s: err %v, want %v", e.name, err, ErrChecksum)
+		}
+	}
+}
+
+func TestVerifyETag(t *testing.T) {
+	f, c := newFakeS3(t)
+	path := testFile(t, "small")
+	if _, err := c.Upload(context.Background(), "tiles.db", path); err != nil {
+		t.Fatal(err)
+	}
+	f.etags["tiles.db"] = fmt.Sprintf("%x", md5.Sum([]byte("other")))
+	if err := c.verify(context.Background(), "tiles.db", 5, fmt.Sprintf("%x", md5.Sum([]byte("small")))); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("err %v for a different md5", err)
+	}
+	// not an md5: only the size is compared
+	f.etags["tiles.db"] = "opaque-etag"
+	if err := c.verify(context.Background(), "tiles.db", 5, fmt.Sprintf("%x", md5.Sum([]byte("small")))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipartETag(t *testing.T) {
+	parts := []Part{}
+	var sums bytes.Buffer
+	for i, data := range []string{"0123", "4567", "89"} {
+		sum := md5.Sum([]byte(data))
+		sums.Write(sum[:])
+		parts = append(parts, Part{Number: i + 1, MD5: hex.EncodeToString(sum[:])})
+	}
+	want := fmt.Sprintf("%x-3", md5.Sum(sums.Bytes()))
+	if got := multipartETag(parts); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}